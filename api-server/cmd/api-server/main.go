@@ -2,35 +2,171 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
-	"runtime"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
-)
 
-var (
-	_, b, _, _ = runtime.Caller(0)
-	basepath   = filepath.Join(filepath.Dir(b), "../..")
+	"AnimeFrameBot/internal/auth"
+	"AnimeFrameBot/internal/catalog"
+	"AnimeFrameBot/internal/certs"
+	"AnimeFrameBot/internal/config"
+	"AnimeFrameBot/internal/frame"
+	"AnimeFrameBot/internal/logging"
+	"AnimeFrameBot/internal/storage"
+	"AnimeFrameBot/internal/upload"
 )
 
-func run(ctx context.Context, addr string) error {
+// resumableSweepInterval is how often expired resumable uploads are removed,
+// or more often with a shorter resumable.expiry.
+const resumableSweepInterval = 10 * time.Minute
+
+// listen opens a TCP listener, or a Unix domain socket for addresses of the
+// form unix:/path/to/socket. A socket file left over by a previous run is removed.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// newStore returns the storage backend selected by cfg.Storage.
+func newStore(cfg *config.Config) (storage.Backend, error) {
+	if cfg.Storage == "s3" {
+		return storage.NewS3(storage.S3Config{
+			Endpoint:        cfg.S3.Endpoint,
+			Region:          cfg.S3.Region,
+			Bucket:          cfg.S3.Bucket,
+			Prefix:          cfg.S3.Prefix,
+			AccessKeyID:     cfg.S3.AccessKeyID,
+			SecretAccessKey: cfg.S3.SecretAccessKey,
+			PartSize:        cfg.S3.PartSize,
+			PresignExpiry:   cfg.S3.PresignExpiry,
+		}, nil)
+	}
+	return storage.NewLocal(cfg.ImageDir), nil
+}
+
+func run(ctx context.Context, args []string, getenv func(string) string, stdout, stderr io.Writer) error {
 	runCtx, runCancel := signal.NotifyContext(ctx, os.Interrupt)
 	defer runCancel()
 
-	serverHandler := NewServer(filepath.Join(basepath, "images"))
+	cfg, err := config.Load(args, getenv, stderr)
+	if err != nil {
+		return err
+	}
+
+	level, _ := logging.ParseLevel(cfg.LogLevel)
+	logger := logging.New(stdout, level)
+	slog.SetDefault(logger)
+
+	var keys *auth.Keyring
+	if cfg.KeysFile != "" {
+		keys, err = auth.LoadKeys(cfg.KeysFile)
+		if err != nil {
+			return err
+		}
+	} else {
+		logger.Warn("authentication is disabled, uploads are open to anyone and the admin routes are off")
+	}
+
+	store, err := newStore(cfg)
+	if err != nil {
+		return err
+	}
+
+	var cat *catalog.Catalog
+	if cfg.CatalogFile != "" {
+		cat, err = catalog.Open(cfg.CatalogFile)
+		if err != nil {
+			return err
+		}
+		defer cat.Close()
+		go func() {
+			report, err := cat.Check(runCtx, store)
+			if err != nil {
+				logger.Error("check catalog", "error", err)
+			} else if !report.Consistent() {
+				logger.Warn("catalog differs from storage", "missing", len(report.Missing), "untracked", len(report.Untracked), "size_mismatch", len(report.SizeMismatch))
+			}
+		}()
+	}
+
+	usage := frame.NewUsage(cat)
+	if cat == nil {
+		logger.Warn("usage statistics are kept in memory only and lost on restart; set catalog_file to keep them")
+	}
+	go usage.Run(runCtx, cfg.Stats.FlushInterval)
+
+	resumable := upload.NewResumable(cfg.Resumable.Dir, cfg.Resumable.Expiry)
+	go resumable.Run(runCtx, min(cfg.Resumable.Expiry, resumableSweepInterval))
+
+	serverHandler := NewServer(cfg, keys, store, cat, usage, resumable)
 	httpServer := &http.Server{
-		Addr:    addr,
-		Handler: serverHandler,
+		Addr:     cfg.Addr,
+		Handler:  serverHandler,
+		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelError),
+	}
+
+	if cfg.TLSCert != "" {
+		reloader, err := certs.NewReloader(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return err
+		}
+		httpServer.TLSConfig = reloader.TLSConfig()
+		go reloader.Watch(runCtx, cfg.TLSReloadInterval)
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			defer signal.Stop(hup)
+			for {
+				select {
+				case <-runCtx.Done():
+					return
+				case <-hup:
+					if err := reloader.Reload(); err != nil {
+						logger.Error("error reloading TLS certificate", "error", err)
+						continue
+					}
+					logger.Info("reloaded TLS certificate on SIGHUP")
+				}
+			}
+		}()
+	}
+
+	listener, err := listen(cfg.Addr)
+	if err != nil {
+		return err
 	}
 
 	go func() {
-		log.Printf("API server listening on %s", httpServer.Addr)
-		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("error listening and serving: %s", err)
+		logger.Info("API server listening", "addr", cfg.Addr, "tls", httpServer.TLSConfig != nil, "storage", cfg.Storage)
+		var err error
+		if httpServer.TLSConfig != nil {
+			// The certificate comes from TLSConfig.GetCertificate, HTTP/2 is negotiated automatically.
+			err = httpServer.ServeTLS(listener, "", "")
+		} else {
+			err = httpServer.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("error listening and serving", "error", err)
+			os.Exit(1)
 		}
 	}()
 
@@ -39,21 +175,31 @@ func run(ctx context.Context, addr string) error {
 	go func() {
 		defer wg.Done()
 		<-runCtx.Done()
-		shutdownCtx, shutdownCancel := context.WithTimeout(ctx, 10*time.Second)
+		// ctx may be the one that was just cancelled; open connections still
+		// get cfg.ShutdownTimeout to finish.
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.WithoutCancel(ctx), cfg.ShutdownTimeout)
 		defer shutdownCancel()
-		log.Println("Shutting down API server")
+		logger.Info("Shutting down API server")
 		if err := httpServer.Shutdown(shutdownCtx); err != nil {
-			log.Fatalf("error shutting down: %s", err)
+			logger.Error("error shutting down", "error", err)
+			os.Exit(1)
+		}
+		if err := usage.Flush(); err != nil {
+			logger.Error("error flushing usage statistics", "error", err)
 		}
 	}()
 	wg.Wait()
-	log.Println("API server closed")
+	logger.Info("API server closed")
 	return nil
 }
 
 func main() {
 	ctx := context.Background()
-	if err := run(ctx, ":8763"); err != nil {
-		log.Fatalf("error running server: %s", err)
+	if err := run(ctx, os.Args[1:], os.Getenv, os.Stdout, os.Stderr); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "error running server: %s\n", err)
+		os.Exit(1)
 	}
 }
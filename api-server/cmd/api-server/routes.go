@@ -2,15 +2,95 @@ package main
 
 import (
 	"net/http"
+	"time"
 
+	"AnimeFrameBot/internal/auth"
+	"AnimeFrameBot/internal/backup"
+	"AnimeFrameBot/internal/catalog"
+	"AnimeFrameBot/internal/config"
 	"AnimeFrameBot/internal/frame"
+	"AnimeFrameBot/internal/health"
+	"AnimeFrameBot/internal/metrics"
+	"AnimeFrameBot/internal/ratelimit"
+	"AnimeFrameBot/internal/storage"
 	"AnimeFrameBot/internal/upload"
 )
 
-func addRoutes(mux *http.ServeMux, imageDir string) {
-	mux.HandleFunc("GET /frame/random/{count}", frame.HandleRandom(imageDir))
-	mux.HandleFunc("GET /frame/fuzzy/{query}/{count}", frame.HandleFuzzy(imageDir))
-	mux.HandleFunc("GET /frame/exact/{query}/{count}", frame.HandleExact(imageDir))
-	mux.HandleFunc("POST /frame", upload.HandleUpload(imageDir))
-	mux.HandleFunc("GET /frame/{image}", frame.HandleDownload(imageDir))
+func addRoutes(mux *http.ServeMux, cfg *config.Config, keys *auth.Keyring, limiter *ratelimit.Limiter, quotas *ratelimit.Quotas, store storage.Backend, cat *catalog.Catalog, usage *frame.Usage, resumable *upload.Resumable) {
+	searchRoute := func(h http.Handler) http.Handler {
+		return auth.Require(keys, auth.ScopeRead, ratelimit.Limit(limiter, ratelimit.ClassSearch, withClient(h)))
+	}
+	downloadRoute := func(h http.Handler) http.Handler {
+		return auth.Require(keys, auth.ScopeRead, ratelimit.Limit(limiter, ratelimit.ClassDownload, h))
+	}
+	uploadRoute := func(h http.Handler) http.Handler {
+		return auth.Require(keys, auth.ScopeUpload, ratelimit.Limit(limiter, ratelimit.ClassUpload, ratelimit.LimitUploads(quotas, h)))
+	}
+
+	index := frame.NewIndex(store, cat)
+	sessions := frame.NewSessions(cfg.Shuffle.SessionTTL, cfg.Shuffle.MaxSessions)
+
+	mux.Handle("GET /frame/random/{count}", searchRoute(frame.HandleRandom(index, usage, sessions, frame.DefaultStrategies(usage), cfg.MaxCount, cfg.MaxBundleBytes)))
+	mux.Handle("GET /frame/fuzzy/{query}/{count}", searchRoute(frame.HandleFuzzy(index, usage, cfg.MaxCount, cfg.MaxBundleBytes)))
+	mux.Handle("GET /frame/exact/{query}/{count}", searchRoute(frame.HandleExact(index, usage, cfg.MaxCount, cfg.MaxBundleBytes)))
+	mux.Handle("GET /frame/daily", searchRoute(frame.HandleDaily(frame.NewDaily(index, cfg.Daily.ExcludeDays), usage, cfg.MaxBundleBytes)))
+	if cfg.Features.Upload {
+		ingester := upload.NewIngester(store, cat, upload.Images{
+			MaxPixels: cfg.Image.MaxPixels,
+			MaxSide:   cfg.Image.MaxSide,
+			Reencode:  cfg.Image.Reencode,
+		})
+		mux.Handle("POST /frame", uploadRoute(upload.HandleUpload(ingester, cfg.MaxUploadBytes)))
+		mux.Handle("POST /frame/batch", uploadRoute(upload.HandleBatch(ingester, cfg.MaxUploadBytes, cfg.MaxBatchBytes)))
+		fetcher := upload.NewFetcher(cfg.Import.Timeout, cfg.MaxUploadBytes, cfg.Import.AllowPrivate)
+		mux.Handle("POST /frame/import", uploadRoute(upload.HandleImport(ingester, fetcher)))
+
+		if resumable != nil {
+			// Chunks of resumable uploads have a budget of their own, so that
+			// clients can resume more often than they start uploads.
+			chunkRoute := func(h http.Handler) http.Handler {
+				return auth.Require(keys, auth.ScopeUpload, ratelimit.Limit(limiter, ratelimit.ClassChunk, h))
+			}
+			mux.Handle("POST /frame/uploads", uploadRoute(upload.HandleResumableCreate(resumable, cfg.MaxUploadBytes, cfg.MaxBatchBytes)))
+			mux.Handle("HEAD /frame/uploads/{id}", chunkRoute(upload.HandleResumableStatus(resumable)))
+			mux.Handle("PATCH /frame/uploads/{id}", chunkRoute(upload.HandleResumableChunk(resumable)))
+			mux.Handle("DELETE /frame/uploads/{id}", chunkRoute(upload.HandleResumableCancel(resumable)))
+			mux.Handle("POST /frame/uploads/{id}/finalize", chunkRoute(ratelimit.LimitUploads(quotas, upload.HandleResumableFinalize(resumable, ingester, cfg.MaxUploadBytes))))
+		}
+	}
+	mux.Handle("GET /frame/{image}", downloadRoute(frame.HandleDownload(store, usage)))
+	mux.Handle("GET /frame/by-hash/{hash}", downloadRoute(frame.HandleByHash(index, store, usage)))
+	mux.Handle("GET /stats/top-frames", searchRoute(frame.HandleTopFrames(index, usage)))
+	mux.Handle("GET /stats/top-queries", searchRoute(frame.HandleTopQueries(usage)))
+	mux.Handle("GET /healthz", health.HandleLive())
+	mux.Handle("GET /readyz", health.HandleReady([]health.Check{
+		health.IndexLoaded(index),
+		health.StorageReadable(store),
+		health.StorageWritable(store),
+		health.MinFreeSpace(store, uint64(cfg.MinFreeBytes)),
+	}))
+	mux.Handle("GET /version", auth.Require(keys, auth.ScopeRead, health.HandleVersion(index, time.Now())))
+	// Admin routes are never served without API keys, even with
+	// authentication disabled.
+	if keys != nil {
+		mux.Handle("GET /admin/backup", auth.Require(keys, auth.ScopeAdmin, backup.HandleBackup(index, store, cat)))
+		mux.Handle("POST /admin/restore", auth.Require(keys, auth.ScopeAdmin, backup.HandleRestore(store, cat)))
+	}
+	if keys != nil && cat != nil {
+		mux.Handle("GET /admin/catalog/check", auth.Require(keys, auth.ScopeAdmin, catalog.HandleCheck(cat, store)))
+		mux.Handle("POST /admin/catalog/repair", auth.Require(keys, auth.ScopeAdmin, catalog.HandleRepair(cat, store)))
+		mux.Handle("GET /admin/export", auth.Require(keys, auth.ScopeAdmin, catalog.HandleExport(cat)))
+		mux.Handle("POST /admin/import", auth.Require(keys, auth.ScopeAdmin, catalog.HandleImport(cat)))
+	}
+	if cfg.Features.Metrics {
+		mux.Handle("GET /metrics", auth.Require(keys, auth.ScopeRead, metrics.Handler()))
+	}
+}
+
+// withClient identifies the client of a request to the frame handlers the way
+// rate limiting does.
+func withClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(frame.WithClient(r.Context(), ratelimit.ClientID(r))))
+	})
 }
@@ -1,15 +1,59 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"time"
+
+	"AnimeFrameBot/internal/auth"
+	"AnimeFrameBot/internal/catalog"
+	"AnimeFrameBot/internal/config"
+	"AnimeFrameBot/internal/frame"
+	"AnimeFrameBot/internal/logging"
+	"AnimeFrameBot/internal/metrics"
+	"AnimeFrameBot/internal/ratelimit"
+	"AnimeFrameBot/internal/storage"
+	"AnimeFrameBot/internal/upload"
+)
+
+var (
+	httpRequests = metrics.NewCounter(
+		"http_requests_total",
+		"HTTP requests served, by route pattern and status code.",
+		"route", "status",
+	)
+	httpDuration = metrics.NewHistogram(
+		"http_request_duration_seconds",
+		"HTTP request latency, by route pattern and status code.",
+		metrics.DefBuckets,
+		"route", "status",
+	)
 )
 
-func NewServer(imagepath string) http.Handler {
+// NewServer returns the handler of all routes. Without resumable, the routes
+// of resumable uploads are not served.
+func NewServer(cfg *config.Config, keys *auth.Keyring, store storage.Backend, cat *catalog.Catalog, usage *frame.Usage, resumable *upload.Resumable) http.Handler {
+	var limiter *ratelimit.Limiter
+	var quotas *ratelimit.Quotas
+	if cfg.Features.RateLimit {
+		limiter = ratelimit.NewLimiter(map[ratelimit.Class]ratelimit.Rate{
+			ratelimit.ClassSearch:   ratelimit.Rate(cfg.RateLimit.Search),
+			ratelimit.ClassDownload: ratelimit.Rate(cfg.RateLimit.Download),
+			ratelimit.ClassUpload:   ratelimit.Rate(cfg.RateLimit.Upload),
+			ratelimit.ClassChunk:    ratelimit.Rate(cfg.RateLimit.Chunk),
+		})
+		quotas = ratelimit.NewQuotas(ratelimit.Quota{
+			MaxBytes: cfg.RateLimit.QuotaBytes,
+			MaxCount: cfg.RateLimit.QuotaCount,
+		})
+	}
+
 	mux := http.NewServeMux()
-	addRoutes(mux, imagepath)
-	var handler http.Handler = loggingMiddleWare(mux)
+	addRoutes(mux, cfg, keys, limiter, quotas, store, cat, usage, resumable)
+	var handler http.Handler = metricsMiddleWare(mux)
+	handler = loggingMiddleWare(handler)
+	handler = logging.RequestIDMiddleware(handler)
 	return handler
 }
 
@@ -31,6 +75,33 @@ func loggingMiddleWare(next http.Handler) http.Handler {
 			statusCode:     http.StatusOK,
 		}
 		next.ServeHTTP(wrapped, r)
-		log.Printf("%s %s -> %d (%s)", r.Method, r.URL, wrapped.statusCode, time.Since(start))
+		slog.InfoContext(r.Context(), "request",
+			"method", r.Method,
+			"url", r.URL.String(),
+			"status", wrapped.statusCode,
+			"duration", time.Since(start),
+			"remote_addr", r.RemoteAddr,
+		)
+	})
+}
+
+// metricsMiddleWare labels requests by the mux pattern instead of the URL,
+// so paths like /frame/{image} do not create a series per file.
+func metricsMiddleWare(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		wrapped := &wrappedWriter{
+			ResponseWriter: w,
+			statusCode:     http.StatusOK,
+		}
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		mux.ServeHTTP(wrapped, r)
+
+		status := strconv.Itoa(wrapped.statusCode)
+		httpRequests.Inc(route, status)
+		httpDuration.Observe(time.Since(start).Seconds(), route, status)
 	})
 }
@@ -6,11 +6,13 @@ require (
 	github.com/brianvoe/gofakeit/v7 v7.0.3
 	github.com/lithammer/fuzzysearch v1.1.8
 	github.com/stretchr/testify v1.9.0
+	go.etcd.io/bbolt v1.3.11
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.5.0 // indirect
 	golang.org/x/text v0.15.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+type Scope string
+
+const (
+	ScopeRead   Scope = "read"
+	ScopeUpload Scope = "upload"
+	ScopeAdmin  Scope = "admin"
+)
+
+func (s Scope) valid() bool {
+	return s == ScopeRead || s == ScopeUpload || s == ScopeAdmin
+}
+
+type Key struct {
+	Name   string  `json:"name"`
+	Token  string  `json:"key"`
+	Scopes []Scope `json:"scopes"`
+}
+
+// Allows reports whether the key grants scope. The admin scope grants every scope.
+func (k Key) Allows(scope Scope) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+type Keyring struct {
+	keys []Key
+}
+
+func NewKeyring(keys []Key) (*Keyring, error) {
+	names := make(map[string]bool)
+	tokens := make(map[string]bool)
+	for _, key := range keys {
+		if key.Name == "" {
+			return nil, fmt.Errorf("key without name")
+		}
+		if names[key.Name] {
+			return nil, fmt.Errorf("duplicate key name: %s", key.Name)
+		}
+		if len(key.Token) < 16 {
+			return nil, fmt.Errorf("key %s: token shorter than 16 characters", key.Name)
+		}
+		if tokens[key.Token] {
+			return nil, fmt.Errorf("key %s: duplicate token", key.Name)
+		}
+		if len(key.Scopes) == 0 {
+			return nil, fmt.Errorf("key %s: no scopes", key.Name)
+		}
+		for _, scope := range key.Scopes {
+			if !scope.valid() {
+				return nil, fmt.Errorf("key %s: invalid scope: %s", key.Name, scope)
+			}
+		}
+		names[key.Name] = true
+		tokens[key.Token] = true
+	}
+	return &Keyring{keys: keys}, nil
+}
+
+// LoadKeys reads a JSON array of keys from path.
+func LoadKeys(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []Key
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return NewKeyring(keys)
+}
+
+// Lookup finds the key matching token. Every key is compared in constant time
+// so the response time does not leak which prefix matched.
+func (kr *Keyring) Lookup(token string) (Key, bool) {
+	var found Key
+	ok := false
+	for _, key := range kr.keys {
+		if subtle.ConstantTimeCompare([]byte(key.Token), []byte(token)) == 1 {
+			found = key
+			ok = true
+		}
+	}
+	return found, ok
+}
+
+type contextKey struct{}
+
+func WithKey(ctx context.Context, key Key) context.Context {
+	return context.WithValue(ctx, contextKey{}, key)
+}
+
+// FromContext returns the key that authenticated the request, if any.
+func FromContext(ctx context.Context) (Key, bool) {
+	key, ok := ctx.Value(contextKey{}).(Key)
+	return key, ok
+}
@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Require only lets requests through that carry an "Authorization: Bearer"
+// key granting scope. A nil keyring disables authentication.
+func Require(keys *Keyring, scope Scope, next http.Handler) http.Handler {
+	if keys == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="AnimeFrameBot"`)
+			http.Error(w, "Missing API key", http.StatusUnauthorized)
+			return
+		}
+
+		key, ok := keys.Lookup(token)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="AnimeFrameBot", error="invalid_token"`)
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+
+		if !key.Allows(scope) {
+			http.Error(w, "API key lacks scope "+string(scope), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithKey(r.Context(), key)))
+	})
+}
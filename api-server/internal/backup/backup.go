@@ -0,0 +1,274 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"AnimeFrameBot/internal/catalog"
+	"AnimeFrameBot/internal/frame"
+	"AnimeFrameBot/internal/storage"
+)
+
+// An archive is a gzipped tar file. Its first entry is the manifest, followed
+// by the frames listed in it under framesDir.
+const (
+	manifestName    = "manifest.json"
+	framesDir       = "frames/"
+	manifestVersion = 1
+
+	// restorePrefix marks frames being restored until their hash is verified.
+	// Hidden objects are not frames.
+	restorePrefix = ".restore-"
+)
+
+// ErrInvalidArchive is wrapped by the errors about the structure of an archive.
+var ErrInvalidArchive = errors.New("invalid archive")
+
+// Manifest describes the frames of an archive.
+type Manifest struct {
+	Version   int             `json:"version"`
+	CreatedAt time.Time       `json:"created_at"`
+	Frames    []catalog.Frame `json:"frames"`
+}
+
+// Write writes an archive of all frames in the index to w. With a catalog,
+// the manifest holds the catalog entries of the frames; without one, the
+// subtitles and hashes from the file names.
+func Write(ctx context.Context, w io.Writer, index *frame.Index, store storage.Backend, cat *catalog.Catalog) error {
+	frames, err := index.Frames(ctx)
+	if err != nil {
+		return err
+	}
+
+	manifest := Manifest{Version: manifestVersion, CreatedAt: time.Now().UTC(), Frames: []catalog.Frame{}}
+	for _, f := range frames {
+		info, err := store.Stat(ctx, f.Filename)
+		if err != nil {
+			return err
+		}
+		entry := catalog.Frame{
+			Name:     f.Filename,
+			Hash:     frame.HashFromFileName(f.Filename),
+			Subtitle: f.Subtitle,
+			AddedAt:  info.ModTime.UTC(),
+		}
+		if cat != nil {
+			cataloged, err := cat.Get(f.Filename)
+			if err != nil && !errors.Is(err, catalog.ErrNotFound) {
+				return err
+			}
+			if err == nil {
+				entry = cataloged
+			}
+		}
+		entry.Size = info.Size
+		manifest.Frames = append(manifest.Frames, entry)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{Name: manifestName, Mode: 0o644, Size: int64(len(data)), ModTime: manifest.CreatedAt}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+
+	for _, f := range manifest.Frames {
+		if err := writeFrame(ctx, tw, store, f); err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeFrame(ctx context.Context, tw *tar.Writer, store storage.Backend, f catalog.Frame) error {
+	file, err := store.Open(ctx, f.Name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	header := &tar.Header{Name: framesDir + f.Name, Mode: 0o644, Size: f.Size, ModTime: f.AddedAt}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// Result reports what a restore did.
+type Result struct {
+	// Restored frames were stored.
+	Restored []string `json:"restored"`
+	// Duplicates were skipped because a frame with the same SHA-256 is stored.
+	Duplicates []string `json:"duplicates"`
+	// Corrupt frames were skipped because their content does not match the
+	// hash or size in the manifest.
+	Corrupt []string `json:"corrupt"`
+	// Missing frames are listed in the manifest, but not in the archive.
+	Missing []string `json:"missing"`
+}
+
+func invalid(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidArchive, fmt.Sprintf(format, args...))
+}
+
+func readManifest(tr *tar.Reader) (Manifest, error) {
+	var manifest Manifest
+	header, err := tr.Next()
+	if err != nil {
+		return manifest, invalid("%v", err)
+	}
+	if header.Name != manifestName {
+		return manifest, invalid("first entry is %q, not %s", header.Name, manifestName)
+	}
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return manifest, invalid("%s: %v", manifestName, err)
+	}
+	if manifest.Version != manifestVersion {
+		return manifest, invalid("manifest version %d is not supported", manifest.Version)
+	}
+
+	names := map[string]bool{}
+	for _, f := range manifest.Frames {
+		if !frame.IsValidFileName(f.Name) || strings.ContainsAny(f.Name, `/\`) {
+			return manifest, invalid("invalid frame name %q", f.Name)
+		}
+		if f.Hash != frame.HashFromFileName(f.Name) {
+			return manifest, invalid("%s: hash %q does not match the name", f.Name, f.Hash)
+		}
+		if names[f.Name] {
+			return manifest, invalid("%s is listed twice", f.Name)
+		}
+		names[f.Name] = true
+	}
+	return manifest, nil
+}
+
+// Restore stores the frames of an archive read from r, verifying their SHA-256
+// and skipping the ones already in store. With a catalog, the manifest entries
+// of the restored frames are added to it.
+//
+// The manifest is validated before any frame is stored. Archives that turn
+// out to be invalid later are not rolled back: the frames restored so far
+// were verified and stay.
+func Restore(ctx context.Context, r io.Reader, store storage.Backend, cat *catalog.Catalog) (Result, error) {
+	result := Result{Restored: []string{}, Duplicates: []string{}, Corrupt: []string{}, Missing: []string{}}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return result, invalid("%v", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	manifest, err := readManifest(tr)
+	if err != nil {
+		return result, err
+	}
+	entries := make(map[string]catalog.Frame, len(manifest.Frames))
+	for _, f := range manifest.Frames {
+		entries[f.Name] = f
+	}
+
+	objects, err := store.List(ctx, "")
+	if err != nil {
+		return result, err
+	}
+	stored := map[string]bool{}
+	for _, obj := range objects {
+		if frame.IsValidFileName(obj.Name) {
+			stored[frame.HashFromFileName(obj.Name)] = true
+		}
+	}
+
+	seen := map[string]bool{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, invalid("%v", err)
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		name, ok := strings.CutPrefix(header.Name, framesDir)
+		entry, listed := entries[name]
+		if !ok || !listed || header.Typeflag != tar.TypeReg {
+			return result, invalid("unexpected entry %q", header.Name)
+		}
+		if seen[name] {
+			return result, invalid("%s is archived twice", name)
+		}
+		seen[name] = true
+
+		if stored[entry.Hash] {
+			result.Duplicates = append(result.Duplicates, name)
+			continue
+		}
+		ok, err = restoreFrame(ctx, store, tr, entry)
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", name, err)
+		}
+		if !ok {
+			result.Corrupt = append(result.Corrupt, name)
+			continue
+		}
+		stored[entry.Hash] = true
+		result.Restored = append(result.Restored, name)
+
+		if cat != nil {
+			if err := cat.Put(entry); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	for _, f := range manifest.Frames {
+		if !seen[f.Name] {
+			result.Missing = append(result.Missing, f.Name)
+		}
+	}
+	return result, nil
+}
+
+// restoreFrame stores a frame under a hidden name first and renames it once
+// its content matches the manifest entry. It reports whether it matched.
+func restoreFrame(ctx context.Context, store storage.Backend, r io.Reader, entry catalog.Frame) (bool, error) {
+	tmp := restorePrefix + entry.Name
+	hash := sha256.New()
+	written, err := store.Put(ctx, tmp, io.TeeReader(r, hash))
+	if err != nil {
+		return false, err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != entry.Hash || written != entry.Size {
+		if err := store.Delete(ctx, tmp); err != nil {
+			slog.ErrorContext(ctx, "delete corrupt frame", "file", tmp, "error", err)
+		}
+		return false, nil
+	}
+	if err := store.Rename(ctx, tmp, entry.Name); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,290 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"AnimeFrameBot/internal/catalog"
+	"AnimeFrameBot/internal/frame"
+	"AnimeFrameBot/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestCatalog(t *testing.T) *catalog.Catalog {
+	t.Helper()
+	cat, err := catalog.Open(filepath.Join(t.TempDir(), "catalog.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { cat.Close() })
+	return cat
+}
+
+func frameName(subtitle, content string) (string, string) {
+	sum := sha256.Sum256([]byte(content))
+	hash := hex.EncodeToString(sum[:])
+	return subtitle + "_" + hash + ".png", hash
+}
+
+type archiveEntry struct {
+	name    string
+	content string
+}
+
+func writeArchive(t *testing.T, entries ...archiveEntry) *bytes.Buffer {
+	t.Helper()
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.content))}))
+		_, err := tw.Write([]byte(e.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return &b
+}
+
+func manifestEntry(t *testing.T, frames ...catalog.Frame) archiveEntry {
+	t.Helper()
+	data, err := json.Marshal(Manifest{Version: manifestVersion, Frames: frames})
+	require.NoError(t, err)
+	return archiveEntry{name: manifestName, content: string(data)}
+}
+
+// unreadableStore fails to open objects.
+type unreadableStore struct {
+	storage.Backend
+}
+
+func (unreadableStore) Open(context.Context, string) (io.ReadSeekCloser, error) {
+	return nil, errors.New("unavailable")
+}
+
+// onceReadableStore opens one object and fails to open any other.
+type onceReadableStore struct {
+	storage.Backend
+	opened bool
+}
+
+func (s *onceReadableStore) Open(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	if s.opened {
+		return nil, errors.New("unavailable")
+	}
+	s.opened = true
+	return s.Backend.Open(ctx, name)
+}
+
+func TestBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemory()
+	cat := openTestCatalog(t)
+	for _, name := range []string{"a.png", "b.png"} {
+		_, err := store.Put(ctx, name, strings.NewReader(name))
+		require.NoError(t, err)
+	}
+	index := frame.NewIndex(store, cat)
+	frames, err := index.Frames(ctx)
+	require.NoError(t, err)
+	require.Len(t, frames, 2)
+	entry, err := cat.Get(frames[0].Filename)
+	require.NoError(t, err)
+	entry.Subtitle = "apple"
+	entry.Metadata = map[string]string{"episode": "1"}
+	require.NoError(t, cat.Put(entry))
+
+	w := httptest.NewRecorder()
+	HandleBackup(index, store, cat).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/backup", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/gzip", w.Header().Get("Content-Type"))
+	archive := w.Body.Bytes()
+
+	// Restoring into an empty library brings back the frames and their metadata.
+	restored := storage.NewMemory()
+	restoredCat := openTestCatalog(t)
+	result, err := Restore(ctx, bytes.NewReader(archive), restored, restoredCat)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{frames[0].Filename, frames[1].Filename}, result.Restored)
+	assert.Empty(t, result.Duplicates)
+	want, err := cat.List()
+	require.NoError(t, err)
+	got, err := restoredCat.List()
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+	objects, err := restored.List(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, objects, 2)
+	restoredFrames, err := frame.NewIndex(restored, restoredCat).Frames(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, restoredFrames, frame.Frame{Filename: entry.Name, Subtitle: "apple", Size: 5, AddedAt: entry.AddedAt})
+
+	// Restoring again skips everything.
+	w = httptest.NewRecorder()
+	HandleRestore(restored, restoredCat).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/restore", bytes.NewReader(archive)))
+	require.Equal(t, http.StatusOK, w.Code)
+	var again Result
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &again))
+	assert.Empty(t, again.Restored)
+	assert.Len(t, again.Duplicates, 2)
+
+	// Without a catalog, the manifest is made from the file names.
+	var b bytes.Buffer
+	require.NoError(t, Write(ctx, &b, frame.NewIndex(restored, nil), restored, nil))
+	gz, err := gzip.NewReader(&b)
+	require.NoError(t, err)
+	manifest, err := readManifest(tar.NewReader(gz))
+	require.NoError(t, err)
+	require.Len(t, manifest.Frames, 2)
+	assert.Equal(t, frame.HashFromFileName(manifest.Frames[0].Name), manifest.Frames[0].Hash)
+	assert.Equal(t, int64(5), manifest.Frames[0].Size)
+
+	// A backup failing before anything was sent is answered with an error.
+	broken := unreadableStore{restored}
+	w = httptest.NewRecorder()
+	HandleBackup(frame.NewIndex(broken, nil), broken, nil).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/backup", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Disposition"))
+
+	// A backup failing after it started aborts the response.
+	large := storage.NewMemory()
+	for _, subtitle := range []string{"first", "second"} {
+		content := make([]byte, 256<<10)
+		_, err := rand.Read(content)
+		require.NoError(t, err)
+		name, _ := frameName(subtitle, string(content))
+		_, err = large.Put(ctx, name, bytes.NewReader(content))
+		require.NoError(t, err)
+	}
+	flaky := &onceReadableStore{Backend: large}
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		HandleBackup(frame.NewIndex(flaky, nil), flaky, nil).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/admin/backup", nil))
+	})
+}
+
+func TestRestore(t *testing.T) {
+	good, goodHash := frameName("good", "good")
+	other, otherHash := frameName("other", "other")
+	stored, storedHash := frameName("stored", "stored")
+	added := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	goodFrame := catalog.Frame{Name: good, Hash: goodHash, Subtitle: "good", Size: 4, AddedAt: added}
+	otherFrame := catalog.Frame{Name: other, Hash: otherHash, Subtitle: "other", Size: 5, AddedAt: added}
+	storedFrame := catalog.Frame{Name: "renamed_" + storedHash + ".png", Hash: storedHash, Size: 6}
+
+	tests := []struct {
+		name       string
+		archive    func(t *testing.T) *bytes.Buffer
+		wantErr    string
+		wantResult Result
+	}{
+		{
+			name: "restores and skips duplicates",
+			archive: func(t *testing.T) *bytes.Buffer {
+				return writeArchive(t,
+					manifestEntry(t, goodFrame, storedFrame),
+					archiveEntry{name: "frames/"},
+					archiveEntry{name: "frames/" + good, content: "good"},
+					archiveEntry{name: "frames/" + storedFrame.Name, content: "stored"},
+				)
+			},
+			wantResult: Result{Restored: []string{good}, Duplicates: []string{storedFrame.Name}, Corrupt: []string{}, Missing: []string{}},
+		},
+		{
+			name: "reports corrupt and missing frames",
+			archive: func(t *testing.T) *bytes.Buffer {
+				return writeArchive(t,
+					manifestEntry(t, goodFrame, otherFrame),
+					archiveEntry{name: "frames/" + good, content: "evil"},
+				)
+			},
+			wantResult: Result{Restored: []string{}, Duplicates: []string{}, Corrupt: []string{good}, Missing: []string{other}},
+		},
+		{
+			name:    "not gzip",
+			archive: func(t *testing.T) *bytes.Buffer { return bytes.NewBufferString("tar") },
+			wantErr: "invalid archive: unexpected EOF",
+		},
+		{
+			name: "manifest not first",
+			archive: func(t *testing.T) *bytes.Buffer {
+				return writeArchive(t, archiveEntry{name: "frames/" + good, content: "good"}, manifestEntry(t, goodFrame))
+			},
+			wantErr: `invalid archive: first entry is "frames/` + good + `", not manifest.json`,
+		},
+		{
+			name: "unsupported version",
+			archive: func(t *testing.T) *bytes.Buffer {
+				return writeArchive(t, archiveEntry{name: manifestName, content: `{"version":2}`})
+			},
+			wantErr: "invalid archive: manifest version 2 is not supported",
+		},
+		{
+			name: "frame outside the library",
+			archive: func(t *testing.T) *bytes.Buffer {
+				escaping := goodFrame
+				escaping.Name = "../" + good
+				return writeArchive(t, manifestEntry(t, escaping))
+			},
+			wantErr: `invalid archive: invalid frame name "../` + good + `"`,
+		},
+		{
+			name: "hash does not match name",
+			archive: func(t *testing.T) *bytes.Buffer {
+				wrong := goodFrame
+				wrong.Hash = otherHash
+				return writeArchive(t, manifestEntry(t, wrong))
+			},
+			wantErr: "invalid archive: " + good + `: hash "` + otherHash + `" does not match the name`,
+		},
+		{
+			name: "frame not in manifest",
+			archive: func(t *testing.T) *bytes.Buffer {
+				return writeArchive(t, manifestEntry(t, goodFrame), archiveEntry{name: "frames/" + other, content: "other"})
+			},
+			wantErr: `invalid archive: unexpected entry "frames/` + other + `"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := storage.NewMemory()
+			_, err := store.Put(ctx, stored, strings.NewReader("stored"))
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			HandleRestore(store, nil).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/restore", tt.archive(t)))
+			if tt.wantErr != "" {
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+				assert.Equal(t, tt.wantErr+"\n", w.Body.String())
+				return
+			}
+			require.Equal(t, http.StatusOK, w.Code)
+			var result Result
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+			assert.Equal(t, tt.wantResult, result)
+
+			// Only verified frames are stored, nothing is left behind.
+			objects, err := store.List(ctx, "")
+			require.NoError(t, err)
+			names := []string{}
+			for _, obj := range objects {
+				names = append(names, obj.Name)
+			}
+			assert.ElementsMatch(t, append([]string{stored}, result.Restored...), names)
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package backup
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"AnimeFrameBot/internal/catalog"
+	"AnimeFrameBot/internal/frame"
+	"AnimeFrameBot/internal/storage"
+)
+
+// backupBufferSize is how much of a backup is held back before the response
+// starts.
+const backupBufferSize = 64 << 10
+
+// HandleBackup streams an archive of all frames.
+func HandleBackup(index *frame.Index, store storage.Backend, cat *catalog.Catalog) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			name := "frames-" + time.Now().UTC().Format("20060102-150405") + ".tar.gz"
+			w.Header().Set("Content-Type", "application/gzip")
+			w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+			// The start of the archive is buffered, so that a backup failing
+			// early can still be answered with an error.
+			sent := &startedWriter{w: w}
+			body := bufio.NewWriterSize(sent, backupBufferSize)
+			err := Write(r.Context(), body, index, store, cat)
+			if err == nil {
+				err = body.Flush()
+			}
+			if err != nil {
+				slog.ErrorContext(r.Context(), "write backup", "error", err)
+				if !sent.started {
+					w.Header().Del("Content-Disposition")
+					http.Error(w, "Error writing backup", http.StatusInternalServerError)
+					return
+				}
+				// Once the archive was started, the status can no longer change;
+				// aborting the connection tells the client it is truncated.
+				panic(http.ErrAbortHandler)
+			}
+			slog.InfoContext(r.Context(), "wrote backup", "file", name)
+		})
+}
+
+// HandleRestore restores the frames of an archive in the request body and
+// reports what was restored and skipped.
+func HandleRestore(store storage.Backend, cat *catalog.Catalog) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			result, err := Restore(r.Context(), r.Body, store, cat)
+			if errors.Is(err, ErrInvalidArchive) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				slog.ErrorContext(r.Context(), "restore backup", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			slog.InfoContext(r.Context(), "restored backup",
+				"restored", len(result.Restored), "duplicates", len(result.Duplicates),
+				"corrupt", len(result.Corrupt), "missing", len(result.Missing))
+
+			bytes, err := json.Marshal(result)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write(bytes)
+		})
+}
+
+// startedWriter records whether anything was written to w.
+type startedWriter struct {
+	w       io.Writer
+	started bool
+}
+
+func (s *startedWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		s.started = true
+	}
+	return s.w.Write(p)
+}
@@ -0,0 +1,445 @@
+package catalog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var ErrNotFound = errors.New("frame not in catalog")
+
+// Frame is the metadata of one frame. The storage backend holds the image
+// under Name, the catalog holds everything else.
+//
+// Width, Height, Format and Colors describe the image; Colors are its dominant
+// colors as "#rrggbb", most common first. They are recorded for uploads, while
+// frames found in the storage backend lack them.
+type Frame struct {
+	Name     string            `json:"name"`
+	Hash     string            `json:"hash"`
+	Subtitle string            `json:"subtitle"`
+	Size     int64             `json:"size"`
+	Width    int               `json:"width,omitempty"`
+	Height   int               `json:"height,omitempty"`
+	Format   string            `json:"format,omitempty"`
+	Colors   []string          `json:"colors,omitempty"`
+	AddedAt  time.Time         `json:"added_at"`
+	Tags     []string          `json:"tags,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+var (
+	bucketMeta     = []byte("meta")
+	bucketFrames   = []byte("frames")   // name -> Frame as JSON
+	bucketHashes   = []byte("hashes")   // hash -> name
+	bucketCounters = []byte("counters") // name \x00 counter -> uint64
+	bucketTags     = []byte("tags")     // tag \x00 name -> nothing
+	bucketDaily    = []byte("daily")    // scope \x00 date -> name
+	bucketQueries  = []byte("queries")  // query -> uint64
+
+	keySchemaVersion = []byte("schema_version")
+	keyFramesVersion = []byte("frames_version")
+)
+
+// Catalog stores frame metadata in a bbolt database file.
+type Catalog struct {
+	db *bolt.DB
+}
+
+// Open opens or creates the database at path and migrates it to the current schema.
+func Open(path string) (*Catalog, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open catalog %s: %w", path, err)
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate catalog %s: %w", path, err)
+	}
+	return &Catalog{db: db}, nil
+}
+
+func (c *Catalog) Close() error {
+	return c.db.Close()
+}
+
+// SchemaVersion returns the number of migrations applied to the database.
+func (c *Catalog) SchemaVersion() (int, error) {
+	var version int
+	err := c.db.View(func(tx *bolt.Tx) error {
+		version = schemaVersion(tx)
+		return nil
+	})
+	return version, err
+}
+
+// Version changes whenever frames are added, replaced or deleted, so callers
+// can tell whether what they derived from the frames is stale. Counters do not
+// change it.
+func (c *Catalog) Version() (uint64, error) {
+	var version uint64
+	err := c.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(bucketMeta).Get(keyFramesVersion); data != nil {
+			version = binary.BigEndian.Uint64(data)
+		}
+		return nil
+	})
+	return version, err
+}
+
+func bumpVersion(tx *bolt.Tx) error {
+	meta := tx.Bucket(bucketMeta)
+	var version uint64
+	if data := meta.Get(keyFramesVersion); data != nil {
+		version = binary.BigEndian.Uint64(data)
+	}
+	return meta.Put(keyFramesVersion, binary.BigEndian.AppendUint64(nil, version+1))
+}
+
+func joinKey(a, b string) []byte {
+	return []byte(a + "\x00" + b)
+}
+
+func getFrame(tx *bolt.Tx, name string) (Frame, error) {
+	data := tx.Bucket(bucketFrames).Get([]byte(name))
+	if data == nil {
+		return Frame{}, fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	var f Frame
+	err := json.Unmarshal(data, &f)
+	return f, err
+}
+
+func putFrame(tx *bolt.Tx, f Frame) error {
+	if f.Name == "" || f.Hash == "" {
+		return errors.New("frame needs a name and a hash")
+	}
+	if old, err := getFrame(tx, f.Name); err == nil {
+		// A frame that keeps its content keeps the hash.
+		if old.Hash != f.Hash {
+			if err := unindexHash(tx, old); err != nil {
+				return err
+			}
+		}
+		if err := unindexTags(tx, old); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketFrames).Put([]byte(f.Name), data); err != nil {
+		return err
+	}
+	// The first frame with some content keeps the hash.
+	hashes := tx.Bucket(bucketHashes)
+	if hashes.Get([]byte(f.Hash)) == nil {
+		if err := hashes.Put([]byte(f.Hash), []byte(f.Name)); err != nil {
+			return err
+		}
+	}
+	for _, tag := range f.Tags {
+		if err := tx.Bucket(bucketTags).Put(joinKey(tag, f.Name), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexFrame removes the hash and tag entries of f.
+func unindexFrame(tx *bolt.Tx, f Frame) error {
+	if err := unindexHash(tx, f); err != nil {
+		return err
+	}
+	return unindexTags(tx, f)
+}
+
+// unindexHash removes the hash entry of f if it points to f. The hash then
+// goes to another frame with the same content, if there is one.
+func unindexHash(tx *bolt.Tx, f Frame) error {
+	hashes := tx.Bucket(bucketHashes)
+	if !bytes.Equal(hashes.Get([]byte(f.Hash)), []byte(f.Name)) {
+		return nil
+	}
+	var duplicate []byte
+	err := tx.Bucket(bucketFrames).ForEach(func(k, v []byte) error {
+		if duplicate != nil || string(k) == f.Name {
+			return nil
+		}
+		var other Frame
+		if err := json.Unmarshal(v, &other); err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+		if other.Hash == f.Hash {
+			duplicate = append([]byte(nil), k...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if duplicate != nil {
+		return hashes.Put([]byte(f.Hash), duplicate)
+	}
+	return hashes.Delete([]byte(f.Hash))
+}
+
+// unindexTags removes the tag entries of f.
+func unindexTags(tx *bolt.Tx, f Frame) error {
+	for _, tag := range f.Tags {
+		if err := tx.Bucket(bucketTags).Delete(joinKey(tag, f.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Put adds or replaces frames, all in one transaction.
+func (c *Catalog) Put(frames ...Frame) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		for _, f := range frames {
+			if err := putFrame(tx, f); err != nil {
+				return fmt.Errorf("%s: %w", f.Name, err)
+			}
+		}
+		return bumpVersion(tx)
+	})
+}
+
+func (c *Catalog) Get(name string) (Frame, error) {
+	var f Frame
+	err := c.db.View(func(tx *bolt.Tx) error {
+		var err error
+		f, err = getFrame(tx, name)
+		return err
+	})
+	return f, err
+}
+
+// ByHash returns the frame with the given content hash.
+func (c *Catalog) ByHash(hash string) (Frame, error) {
+	var f Frame
+	err := c.db.View(func(tx *bolt.Tx) error {
+		name := tx.Bucket(bucketHashes).Get([]byte(hash))
+		if name == nil {
+			return fmt.Errorf("%s: %w", hash, ErrNotFound)
+		}
+		var err error
+		f, err = getFrame(tx, string(name))
+		return err
+	})
+	return f, err
+}
+
+// ByTag returns the frames with the given tag, sorted by name.
+func (c *Catalog) ByTag(tag string) ([]Frame, error) {
+	frames := []Frame{}
+	prefix := joinKey(tag, "")
+	err := c.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(bucketTags).Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			f, err := getFrame(tx, string(k[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			frames = append(frames, f)
+		}
+		return nil
+	})
+	return frames, err
+}
+
+// List returns all frames sorted by name.
+func (c *Catalog) List() ([]Frame, error) {
+	frames := []Frame{}
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketFrames).ForEach(func(k, v []byte) error {
+			var f Frame
+			if err := json.Unmarshal(v, &f); err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+			frames = append(frames, f)
+			return nil
+		})
+	})
+	return frames, err
+}
+
+// Delete removes frames together with their counters. Missing frames are ignored.
+func (c *Catalog) Delete(names ...string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range names {
+			f, err := getFrame(tx, name)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := unindexFrame(tx, f); err != nil {
+				return err
+			}
+			if err := tx.Bucket(bucketFrames).Delete([]byte(name)); err != nil {
+				return err
+			}
+
+			counters := tx.Bucket(bucketCounters)
+			prefix := joinKey(name, "")
+			var keys [][]byte
+			cursor := counters.Cursor()
+			for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+				keys = append(keys, k)
+			}
+			for _, k := range keys {
+				if err := counters.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return bumpVersion(tx)
+	})
+}
+
+// Increment adds delta to a named counter of a frame and returns the new value.
+func (c *Catalog) Increment(name, counter string, delta uint64) (uint64, error) {
+	var value uint64
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		if _, err := getFrame(tx, name); err != nil {
+			return err
+		}
+		counters := tx.Bucket(bucketCounters)
+		key := joinKey(name, counter)
+		if data := counters.Get(key); data != nil {
+			value = binary.BigEndian.Uint64(data)
+		}
+		value += delta
+		return counters.Put(key, binary.BigEndian.AppendUint64(nil, value))
+	})
+	return value, err
+}
+
+// AddCounters adds deltas, counter values by counter name by frame name, to
+// the counters of the frames in one transaction. Frames not in the catalog are
+// skipped.
+func (c *Catalog) AddCounters(deltas map[string]map[string]uint64) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		counters := tx.Bucket(bucketCounters)
+		for name, frameDeltas := range deltas {
+			if _, err := getFrame(tx, name); errors.Is(err, ErrNotFound) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			for counter, delta := range frameDeltas {
+				if err := addUint64(counters, joinKey(name, counter), delta); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func addUint64(bucket *bolt.Bucket, key []byte, delta uint64) error {
+	var value uint64
+	if data := bucket.Get(key); data != nil {
+		value = binary.BigEndian.Uint64(data)
+	}
+	return bucket.Put(key, binary.BigEndian.AppendUint64(nil, value+delta))
+}
+
+// AddQueries adds deltas to the counts of search queries.
+func (c *Catalog) AddQueries(deltas map[string]uint64) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		queries := tx.Bucket(bucketQueries)
+		for query, delta := range deltas {
+			if err := addUint64(queries, []byte(query), delta); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Queries returns the counts of search queries.
+func (c *Catalog) Queries() (map[string]uint64, error) {
+	queries := map[string]uint64{}
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketQueries).ForEach(func(k, v []byte) error {
+			queries[string(k)] = binary.BigEndian.Uint64(v)
+			return nil
+		})
+	})
+	return queries, err
+}
+
+// Counters returns the counters of a frame.
+func (c *Catalog) Counters(name string) (map[string]uint64, error) {
+	counters := map[string]uint64{}
+	prefix := joinKey(name, "")
+	err := c.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(bucketCounters).Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			counters[string(k[len(prefix):])] = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+	return counters, err
+}
+
+// CounterValues returns the value of a counter for every frame that has it,
+// by frame name.
+func (c *Catalog) CounterValues(counter string) (map[string]uint64, error) {
+	values := map[string]uint64{}
+	suffix := []byte("\x00" + counter)
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketCounters).ForEach(func(k, v []byte) error {
+			if name, ok := bytes.CutSuffix(k, suffix); ok && !bytes.Contains(name, []byte{0}) {
+				values[string(name)] = binary.BigEndian.Uint64(v)
+			}
+			return nil
+		})
+	})
+	return values, err
+}
+
+// DailyPicks returns the frames picked for scope on the dates from first to
+// last, both included, by date. Dates have the form 2006-01-02.
+func (c *Catalog) DailyPicks(scope, first, last string) (map[string]string, error) {
+	picks := map[string]string{}
+	prefix := joinKey(scope, "")
+	end := joinKey(scope, last)
+	err := c.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(bucketDaily).Cursor()
+		for k, v := cursor.Seek(joinKey(scope, first)); k != nil && bytes.Compare(k, end) <= 0; k, v = cursor.Next() {
+			picks[string(k[len(prefix):])] = string(v)
+		}
+		return nil
+	})
+	return picks, err
+}
+
+// SetDailyPick records name as the frame picked for scope on date, unless
+// the recorded pick is no longer old, e.g. because a concurrent request
+// recorded another one. old is "" if there was none. It returns the pick
+// recorded in the end.
+func (c *Catalog) SetDailyPick(scope, date, old, name string) (string, error) {
+	recorded := name
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		daily := tx.Bucket(bucketDaily)
+		key := joinKey(scope, date)
+		if current := string(daily.Get(key)); current != old {
+			recorded = current
+			return nil
+		}
+		return daily.Put(key, []byte(name))
+	})
+	return recorded, err
+}
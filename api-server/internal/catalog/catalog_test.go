@@ -0,0 +1,376 @@
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"AnimeFrameBot/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestCatalog(t *testing.T) *Catalog {
+	t.Helper()
+	cat, err := Open(filepath.Join(t.TempDir(), "catalog.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { cat.Close() })
+	return cat
+}
+
+func TestCatalog(t *testing.T) {
+	cat := openTestCatalog(t)
+	added := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	require.NoError(t, cat.Put(
+		Frame{Name: "a_1.png", Hash: "1", Subtitle: "a", Size: 10, AddedAt: added, Tags: []string{"s1", "cat"}},
+		Frame{Name: "b_2.png", Hash: "2", Subtitle: "b", Size: 20, AddedAt: added, Tags: []string{"s1"}, Metadata: map[string]string{"episode": "3"}},
+	))
+	assert.EqualError(t, cat.Put(Frame{Name: "c.png"}), "c.png: frame needs a name and a hash")
+
+	f, err := cat.Get("b_2.png")
+	require.NoError(t, err)
+	assert.Equal(t, "3", f.Metadata["episode"])
+	assert.Equal(t, added, f.AddedAt)
+
+	f, err = cat.ByHash("1")
+	require.NoError(t, err)
+	assert.Equal(t, "a_1.png", f.Name)
+	_, err = cat.ByHash("3")
+	assert.True(t, errors.Is(err, ErrNotFound))
+	_, err = cat.Get("c.png")
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	frames, err := cat.ByTag("s1")
+	require.NoError(t, err)
+	assert.Len(t, frames, 2)
+
+	// Replacing a frame updates the tag index.
+	f, err = cat.Get("a_1.png")
+	require.NoError(t, err)
+	f.Subtitle = "apple"
+	f.Tags = []string{"fruit"}
+	require.NoError(t, cat.Put(f))
+	frames, err = cat.ByTag("s1")
+	require.NoError(t, err)
+	require.Len(t, frames, 1)
+	assert.Equal(t, "b_2.png", frames[0].Name)
+	frames, err = cat.ByTag("fruit")
+	require.NoError(t, err)
+	require.Len(t, frames, 1)
+	assert.Equal(t, "apple", frames[0].Subtitle)
+
+	n, err := cat.Increment("a_1.png", "downloads", 1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), n)
+	n, err = cat.Increment("a_1.png", "downloads", 2)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), n)
+	_, err = cat.Increment("a_1.png", "searches", 5)
+	require.NoError(t, err)
+	_, err = cat.Increment("c.png", "downloads", 1)
+	assert.True(t, errors.Is(err, ErrNotFound))
+	counters, err := cat.Counters("a_1.png")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{"downloads": 3, "searches": 5}, counters)
+	_, err = cat.Increment("b_2.png", "downloads", 1)
+	require.NoError(t, err)
+	values, err := cat.CounterValues("downloads")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{"a_1.png": 3, "b_2.png": 1}, values)
+
+	require.NoError(t, cat.Delete("a_1.png", "c.png"))
+	frames, err = cat.List()
+	require.NoError(t, err)
+	require.Len(t, frames, 1)
+	assert.Equal(t, "b_2.png", frames[0].Name)
+	_, err = cat.ByHash("1")
+	assert.True(t, errors.Is(err, ErrNotFound))
+	counters, err = cat.Counters("a_1.png")
+	require.NoError(t, err)
+	assert.Empty(t, counters)
+	frames, err = cat.ByTag("fruit")
+	require.NoError(t, err)
+	assert.Empty(t, frames)
+}
+
+func TestDuplicateHashes(t *testing.T) {
+	cat := openTestCatalog(t)
+	require.NoError(t, cat.Put(
+		Frame{Name: "a_1.png", Hash: "1"},
+		Frame{Name: "b_1.png", Hash: "1"},
+		Frame{Name: "c_1.png", Hash: "1"},
+	))
+	byHash := func() string {
+		t.Helper()
+		f, err := cat.ByHash("1")
+		require.NoError(t, err)
+		return f.Name
+	}
+
+	// The first frame keeps the hash, also when it is replaced.
+	require.NoError(t, cat.Put(Frame{Name: "a_1.png", Hash: "1", Subtitle: "a"}))
+	assert.Equal(t, "a_1.png", byHash())
+
+	// Removing a duplicate that does not hold the hash leaves it alone.
+	require.NoError(t, cat.Delete("b_1.png"))
+	assert.Equal(t, "a_1.png", byHash())
+
+	// Removing the frame that holds the hash passes it to the one left.
+	require.NoError(t, cat.Delete("a_1.png"))
+	assert.Equal(t, "c_1.png", byHash())
+
+	// So does replacing it with other content.
+	require.NoError(t, cat.Put(Frame{Name: "d_1.png", Hash: "1"}, Frame{Name: "c_1.png", Hash: "2"}))
+	assert.Equal(t, "d_1.png", byHash())
+
+	require.NoError(t, cat.Delete("d_1.png"))
+	_, err := cat.ByHash("1")
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestAddCounters(t *testing.T) {
+	cat := openTestCatalog(t)
+	require.NoError(t, cat.Put(Frame{Name: "a_1.png", Hash: "1"}, Frame{Name: "b_2.png", Hash: "2"}))
+	version, err := cat.Version()
+	require.NoError(t, err)
+
+	require.NoError(t, cat.AddCounters(map[string]map[string]uint64{
+		"a_1.png": {"downloads": 2, "searches": 5},
+		"b_2.png": {"searches": 1},
+		"c_3.png": {"searches": 1},
+	}))
+	require.NoError(t, cat.AddCounters(map[string]map[string]uint64{"a_1.png": {"downloads": 1}}))
+	counters, err := cat.Counters("a_1.png")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{"downloads": 3, "searches": 5}, counters)
+	values, err := cat.CounterValues("searches")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{"a_1.png": 5, "b_2.png": 1}, values)
+
+	require.NoError(t, cat.AddQueries(map[string]uint64{"hello": 2, "こんにちは": 1}))
+	require.NoError(t, cat.AddQueries(map[string]uint64{"hello": 1}))
+	queries, err := cat.Queries()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{"hello": 3, "こんにちは": 1}, queries)
+
+	// Counting does not invalidate what was derived from the frames.
+	after, err := cat.Version()
+	require.NoError(t, err)
+	assert.Equal(t, version, after)
+}
+
+func TestDailyPicks(t *testing.T) {
+	cat := openTestCatalog(t)
+
+	recorded, err := cat.SetDailyPick("chat=1", "2024-06-01", "", "a_1.png")
+	require.NoError(t, err)
+	assert.Equal(t, "a_1.png", recorded)
+	// Another request recorded a pick first.
+	recorded, err = cat.SetDailyPick("chat=1", "2024-06-01", "", "b_2.png")
+	require.NoError(t, err)
+	assert.Equal(t, "a_1.png", recorded)
+	// Replacing a pick, e.g. of a deleted frame.
+	recorded, err = cat.SetDailyPick("chat=1", "2024-06-01", "a_1.png", "b_2.png")
+	require.NoError(t, err)
+	assert.Equal(t, "b_2.png", recorded)
+
+	for date, name := range map[string]string{"2024-05-30": "c_3.png", "2024-05-31": "a_1.png", "2024-06-02": "c_3.png"} {
+		_, err := cat.SetDailyPick("chat=1", date, "", name)
+		require.NoError(t, err)
+	}
+	_, err = cat.SetDailyPick("chat=2", "2024-05-31", "", "d_4.png")
+	require.NoError(t, err)
+
+	picks, err := cat.DailyPicks("chat=1", "2024-05-31", "2024-06-01")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"2024-05-31": "a_1.png", "2024-06-01": "b_2.png"}, picks)
+	picks, err = cat.DailyPicks("chat=3", "2024-05-01", "2024-06-30")
+	require.NoError(t, err)
+	assert.Empty(t, picks)
+}
+
+func TestMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "catalog.db")
+	cat, err := Open(path)
+	require.NoError(t, err)
+	version, err := cat.SchemaVersion()
+	require.NoError(t, err)
+	assert.Equal(t, len(migrations), version)
+	require.NoError(t, cat.Put(Frame{Name: "a_1.png", Hash: "1"}))
+	require.NoError(t, cat.Close())
+
+	db, err := bolt.Open(path, 0o600, nil)
+	require.NoError(t, err)
+
+	// Pending migrations run in order, once.
+	var ran []int
+	next := append(migrations[:len(migrations):len(migrations)],
+		func(tx *bolt.Tx) error { ran = append(ran, 1); return nil },
+		func(tx *bolt.Tx) error { ran = append(ran, 2); return nil },
+	)
+	require.NoError(t, migrateTo(db, next))
+	require.NoError(t, migrateTo(db, next))
+	assert.Equal(t, []int{1, 2}, ran)
+
+	// A failed migration is rolled back and stops the later ones.
+	failing := append(next[:len(next):len(next)],
+		func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucket([]byte("partial"))
+			require.NoError(t, err)
+			return errors.New("broken")
+		},
+		func(tx *bolt.Tx) error { ran = append(ran, 4); return nil },
+	)
+	assert.EqualError(t, migrateTo(db, failing), "migration "+strconv.Itoa(len(next)+1)+": broken")
+	assert.Equal(t, []int{1, 2}, ran)
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		assert.Nil(t, tx.Bucket([]byte("partial")))
+		assert.Equal(t, len(next), schemaVersion(tx))
+		return nil
+	}))
+	require.NoError(t, db.Close())
+
+	// The current server refuses a database migrated by a newer one.
+	_, err = Open(path)
+	assert.ErrorContains(t, err, "is newer than this server supports")
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	cat := openTestCatalog(t)
+	store := storage.NewMemory()
+	for _, name := range []string{"a_1.png", "b_2.png", "c_3.png", ".readyz"} {
+		_, err := store.Put(ctx, name, strings.NewReader(name))
+		require.NoError(t, err)
+	}
+	require.NoError(t, cat.Put(
+		Frame{Name: "a_1.png", Hash: "1", Size: 7},
+		Frame{Name: "b_2.png", Hash: "2", Size: 1},
+		Frame{Name: "d_4.png", Hash: "4", Size: 7},
+	))
+
+	report, err := cat.Check(ctx, store)
+	require.NoError(t, err)
+	assert.Equal(t, Report{
+		Frames:       3,
+		Objects:      3,
+		Missing:      []string{"d_4.png"},
+		Untracked:    []string{"c_3.png"},
+		SizeMismatch: []string{"b_2.png"},
+	}, report)
+	assert.False(t, report.Consistent())
+
+	w := httptest.NewRecorder()
+	HandleRepair(cat, store).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/catalog/repair", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var repaired Report
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &repaired))
+	assert.Equal(t, report, repaired)
+
+	w = httptest.NewRecorder()
+	HandleCheck(cat, store).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/catalog/check", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var checked Report
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &checked))
+	assert.Empty(t, checked.Missing)
+	assert.Equal(t, 2, checked.Frames)
+
+	_, err = cat.Check(ctx, storage.NewLocal(filepath.Join(t.TempDir(), "nonexistent")))
+	assert.Error(t, err)
+}
+
+func TestExportImport(t *testing.T) {
+	cat := openTestCatalog(t)
+	added := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, cat.Put(
+		Frame{Name: "a_1.png", Hash: "1", Subtitle: "a", AddedAt: added, Tags: []string{"s1", "cat"}},
+		Frame{Name: "b_2.png", Hash: "2", Subtitle: "b, \"quoted\"", AddedAt: added, Metadata: map[string]string{"episode": "3"}},
+	))
+
+	var b strings.Builder
+	require.NoError(t, cat.Export(&b, FormatCSV))
+	assert.Equal(t, "name,hash,subtitle,tags,episode\n"+
+		"a_1.png,1,a,s1|cat,\n"+
+		"b_2.png,2,\"b, \"\"quoted\"\"\",,3\n", b.String())
+	assert.ErrorIs(t, cat.Export(&b, "xml"), ErrFormat)
+
+	// An unedited export changes nothing.
+	for _, format := range []string{FormatCSV, FormatJSONL} {
+		var b strings.Builder
+		require.NoError(t, cat.Export(&b, format))
+		updates, err := ParseUpdates(strings.NewReader(b.String()), format)
+		require.NoError(t, err)
+		result, err := cat.Import(updates)
+		require.NoError(t, err)
+		assert.Equal(t, ImportResult{Unchanged: 2, NotFound: []string{}}, result, format)
+	}
+
+	tests := []struct {
+		name       string
+		format     string
+		input      string
+		wantErr    string
+		wantResult ImportResult
+		wantFrames []Frame
+	}{
+		{
+			name:   "csv",
+			format: FormatCSV,
+			input: "hash,subtitle,tags,episode,season\n" +
+				"1,apple,,1,\n" +
+				"2,b,s2,,2\n" +
+				"9,unknown,,,\n",
+			wantResult: ImportResult{Updated: 2, NotFound: []string{"9"}},
+			wantFrames: []Frame{
+				{Name: "a_1.png", Hash: "1", Subtitle: "apple", AddedAt: added, Metadata: map[string]string{"episode": "1"}},
+				{Name: "b_2.png", Hash: "2", Subtitle: "b", AddedAt: added, Tags: []string{"s2"}, Metadata: map[string]string{"season": "2"}},
+			},
+		},
+		{
+			name:       "jsonl only changes given fields",
+			format:     FormatJSONL,
+			input:      `{"hash":"1","subtitle":"apple"}` + "\n" + `{"hash":"1","tags":["fruit"]}`,
+			wantResult: ImportResult{Updated: 1, NotFound: []string{}},
+			wantFrames: []Frame{
+				{Name: "a_1.png", Hash: "1", Subtitle: "apple", AddedAt: added, Tags: []string{"fruit"}},
+				{Name: "b_2.png", Hash: "2", Subtitle: "b, \"quoted\"", AddedAt: added, Metadata: map[string]string{"episode": "3"}},
+			},
+		},
+		{name: "csv without hash", format: FormatCSV, input: "name,subtitle\na_1.png,x\n", wantErr: "csv needs a hash column"},
+		{name: "jsonl without hash", format: FormatJSONL, input: `{"subtitle":"x"}`, wantErr: "record 1: hash is missing"},
+		{name: "invalid jsonl", format: FormatJSONL, input: `{"hash":"1"}` + "\n{", wantErr: "record 2: unexpected EOF"},
+		{name: "unknown format", format: "xml", input: "", wantErr: ErrFormat.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cat := openTestCatalog(t)
+			require.NoError(t, cat.Put(
+				Frame{Name: "a_1.png", Hash: "1", Subtitle: "a", AddedAt: added, Tags: []string{"s1", "cat"}},
+				Frame{Name: "b_2.png", Hash: "2", Subtitle: "b, \"quoted\"", AddedAt: added, Metadata: map[string]string{"episode": "3"}},
+			))
+
+			updates, err := ParseUpdates(strings.NewReader(tt.input), tt.format)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			result, err := cat.Import(updates)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantResult, result)
+			frames, err := cat.List()
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantFrames, frames)
+		})
+	}
+}
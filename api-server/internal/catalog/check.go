@@ -0,0 +1,77 @@
+package catalog
+
+import (
+	"context"
+	"strings"
+
+	"AnimeFrameBot/internal/storage"
+)
+
+// Report is the result of comparing the catalog with the storage backend.
+type Report struct {
+	Frames  int `json:"frames"`
+	Objects int `json:"objects"`
+	// Missing frames are in the catalog, but their object is gone.
+	Missing []string `json:"missing"`
+	// Untracked objects are stored, but not in the catalog.
+	Untracked []string `json:"untracked"`
+	// SizeMismatch lists frames whose object has a different size than recorded.
+	SizeMismatch []string `json:"size_mismatch"`
+}
+
+func (r Report) Consistent() bool {
+	return len(r.Missing) == 0 && len(r.Untracked) == 0 && len(r.SizeMismatch) == 0
+}
+
+// Check compares the catalog with the objects of store. Hidden objects, whose
+// names start with ".", are not frames and are ignored.
+func (c *Catalog) Check(ctx context.Context, store storage.Backend) (Report, error) {
+	report := Report{Missing: []string{}, Untracked: []string{}, SizeMismatch: []string{}}
+	objects, err := store.List(ctx, "")
+	if err != nil {
+		return report, err
+	}
+	frames, err := c.List()
+	if err != nil {
+		return report, err
+	}
+
+	sizes := make(map[string]int64, len(objects))
+	for _, obj := range objects {
+		if strings.HasPrefix(obj.Name, ".") {
+			continue
+		}
+		sizes[obj.Name] = obj.Size
+		report.Objects++
+	}
+	report.Frames = len(frames)
+
+	tracked := make(map[string]bool, len(frames))
+	for _, f := range frames {
+		tracked[f.Name] = true
+		size, ok := sizes[f.Name]
+		switch {
+		case !ok:
+			report.Missing = append(report.Missing, f.Name)
+		case size != f.Size:
+			report.SizeMismatch = append(report.SizeMismatch, f.Name)
+		}
+	}
+	for _, obj := range objects {
+		if _, ok := sizes[obj.Name]; ok && !tracked[obj.Name] {
+			report.Untracked = append(report.Untracked, obj.Name)
+		}
+	}
+	return report, nil
+}
+
+// Repair removes the missing frames from the catalog and returns the report
+// from before the repair. Untracked objects are added by the frame index when
+// it scans the backend.
+func (c *Catalog) Repair(ctx context.Context, store storage.Backend) (Report, error) {
+	report, err := c.Check(ctx, store)
+	if err != nil {
+		return report, err
+	}
+	return report, c.Delete(report.Missing...)
+}
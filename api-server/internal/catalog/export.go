@@ -0,0 +1,241 @@
+package catalog
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Export and import formats.
+const (
+	FormatJSONL = "jsonl"
+	FormatCSV   = "csv"
+)
+
+// tagSeparator joins the tags of a frame into one CSV field.
+const tagSeparator = "|"
+
+// CSV columns with a fixed meaning. Every other column is a metadata key.
+var csvColumns = []string{"name", "hash", "subtitle", "tags"}
+
+var ErrFormat = errors.New("format must be jsonl or csv")
+
+// Export writes all frames to w, one JSON object per line or one CSV row per
+// frame. CSV files have a column per metadata key used by any frame.
+func (c *Catalog) Export(w io.Writer, format string) error {
+	frames, err := c.List()
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case FormatJSONL:
+		enc := json.NewEncoder(w)
+		for _, f := range frames {
+			if err := enc.Encode(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FormatCSV:
+		keys := map[string]bool{}
+		for _, f := range frames {
+			for k := range f.Metadata {
+				keys[k] = true
+			}
+		}
+		metaColumns := make([]string, 0, len(keys))
+		for k := range keys {
+			metaColumns = append(metaColumns, k)
+		}
+		sort.Strings(metaColumns)
+
+		cw := csv.NewWriter(w)
+		if err := cw.Write(append(slices.Clone(csvColumns), metaColumns...)); err != nil {
+			return err
+		}
+		for _, f := range frames {
+			row := []string{f.Name, f.Hash, f.Subtitle, strings.Join(f.Tags, tagSeparator)}
+			for _, k := range metaColumns {
+				row = append(row, f.Metadata[k])
+			}
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return ErrFormat
+	}
+}
+
+// Update is one record of an import. Nil fields are left unchanged. Metadata
+// is merged into the frame's metadata; an empty value removes the key.
+type Update struct {
+	Hash     string            `json:"hash"`
+	Subtitle *string           `json:"subtitle"`
+	Tags     *[]string         `json:"tags"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// ImportResult reports what an import changed.
+type ImportResult struct {
+	Updated   int      `json:"updated"`
+	Unchanged int      `json:"unchanged"`
+	NotFound  []string `json:"not_found"`
+}
+
+// ParseUpdates reads updates in the given format. Exported files can be read
+// back; their name and size fields are ignored, frames are found by hash.
+func ParseUpdates(r io.Reader, format string) ([]Update, error) {
+	var updates []Update
+	switch format {
+	case FormatJSONL:
+		dec := json.NewDecoder(r)
+		for line := 1; ; line++ {
+			var u Update
+			err := dec.Decode(&u)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("record %d: %w", line, err)
+			}
+			updates = append(updates, u)
+		}
+	case FormatCSV:
+		cr := csv.NewReader(r)
+		header, err := cr.Read()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(header, "hash") {
+			return nil, errors.New("csv needs a hash column")
+		}
+		for {
+			row, err := cr.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			u := Update{Metadata: map[string]string{}}
+			for i, column := range header {
+				value := row[i]
+				switch column {
+				case "name":
+				case "hash":
+					u.Hash = value
+				case "subtitle":
+					u.Subtitle = &value
+				case "tags":
+					tags := []string{}
+					if value != "" {
+						tags = strings.Split(value, tagSeparator)
+					}
+					u.Tags = &tags
+				default:
+					u.Metadata[column] = value
+				}
+			}
+			updates = append(updates, u)
+		}
+	default:
+		return nil, ErrFormat
+	}
+
+	for i, u := range updates {
+		if u.Hash == "" {
+			return nil, fmt.Errorf("record %d: hash is missing", i+1)
+		}
+	}
+	return updates, nil
+}
+
+// Import applies updates to the frames with matching hashes, all in one
+// transaction. Updates for unknown hashes are reported, not applied.
+func (c *Catalog) Import(updates []Update) (ImportResult, error) {
+	result := ImportResult{NotFound: []string{}}
+	changed := map[string]Frame{}
+	for _, u := range updates {
+		f, err := c.ByHash(u.Hash)
+		if errors.Is(err, ErrNotFound) {
+			result.NotFound = append(result.NotFound, u.Hash)
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		// Later updates of the same frame see the earlier ones.
+		if pending, ok := changed[f.Name]; ok {
+			f = pending
+		}
+
+		updated, ok := applyUpdate(f, u)
+		if !ok {
+			result.Unchanged++
+			continue
+		}
+		if _, ok := changed[f.Name]; !ok {
+			result.Updated++
+		}
+		changed[f.Name] = updated
+	}
+
+	frames := make([]Frame, 0, len(changed))
+	for _, f := range changed {
+		frames = append(frames, f)
+	}
+	if len(frames) == 0 {
+		return result, nil
+	}
+	return result, c.Put(frames...)
+}
+
+// applyUpdate returns f with u applied and whether that changed anything.
+func applyUpdate(f Frame, u Update) (Frame, bool) {
+	changed := false
+	if u.Subtitle != nil && *u.Subtitle != f.Subtitle {
+		f.Subtitle = *u.Subtitle
+		changed = true
+	}
+	if u.Tags != nil && !slices.Equal(*u.Tags, f.Tags) {
+		f.Tags = *u.Tags
+		if len(f.Tags) == 0 {
+			f.Tags = nil
+		}
+		changed = true
+	}
+	if len(u.Metadata) > 0 {
+		metadata := maps.Clone(f.Metadata)
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		for k, v := range u.Metadata {
+			if v == "" {
+				delete(metadata, k)
+			} else {
+				metadata[k] = v
+			}
+		}
+		if len(metadata) == 0 {
+			metadata = nil
+		}
+		if !maps.Equal(metadata, f.Metadata) {
+			f.Metadata = metadata
+			changed = true
+		}
+	}
+	return f, changed
+}
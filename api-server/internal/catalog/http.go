@@ -0,0 +1,114 @@
+package catalog
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"AnimeFrameBot/internal/storage"
+)
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(bytes)
+}
+
+// HandleCheck reports the differences between the catalog and the storage backend.
+func HandleCheck(cat *Catalog, store storage.Backend) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			report, err := cat.Check(r.Context(), store)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "check catalog", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, report)
+		})
+}
+
+// HandleRepair removes missing frames from the catalog and reports what was found.
+func HandleRepair(cat *Catalog, store storage.Backend) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			report, err := cat.Repair(r.Context(), store)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "repair catalog", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			slog.InfoContext(r.Context(), "repaired catalog", "removed", len(report.Missing))
+			writeJSON(w, http.StatusOK, report)
+		})
+}
+
+// maxImportBytes bounds the size of an import.
+const maxImportBytes = 64 << 20
+
+func requestFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+	return FormatJSONL
+}
+
+// HandleExport streams all frames as JSON Lines or CSV, chosen by the format
+// query parameter.
+func HandleExport(cat *Catalog) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			format := requestFormat(r)
+			switch format {
+			case FormatJSONL:
+				w.Header().Set("Content-Type", "application/x-ndjson")
+			case FormatCSV:
+				w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			default:
+				http.Error(w, ErrFormat.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Disposition", `attachment; filename="frames.`+format+`"`)
+			if err := cat.Export(w, format); err != nil {
+				// Once frames were written, the status can no longer change;
+				// aborting the connection tells the client the export is
+				// truncated.
+				slog.ErrorContext(r.Context(), "export catalog", "error", err)
+				panic(http.ErrAbortHandler)
+			}
+		})
+}
+
+// HandleImport updates subtitles, tags and metadata of the frames in the
+// request body, matched by hash, and reports what changed.
+func HandleImport(cat *Catalog) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+			updates, err := ParseUpdates(r.Body, requestFormat(r))
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			result, err := cat.Import(updates)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "import catalog", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			slog.InfoContext(r.Context(), "imported catalog", "updated", result.Updated, "not_found", len(result.NotFound))
+			writeJSON(w, http.StatusOK, result)
+		})
+}
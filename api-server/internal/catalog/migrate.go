@@ -0,0 +1,77 @@
+package catalog
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// migrations bring the database from one schema version to the next:
+// migrations[i] upgrades version i to i+1. Applied migrations must never
+// change; add new ones at the end.
+var migrations = []func(tx *bolt.Tx) error{
+	// 1: frames with hash and tag indexes, and their counters.
+	func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketFrames, bucketHashes, bucketCounters, bucketTags} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 2: daily picks.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketDaily)
+		return err
+	},
+	// 3: search query counts.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketQueries)
+		return err
+	},
+}
+
+func schemaVersion(tx *bolt.Tx) int {
+	meta := tx.Bucket(bucketMeta)
+	if meta == nil {
+		return 0
+	}
+	data := meta.Get(keySchemaVersion)
+	if data == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(data))
+}
+
+// migrate applies the pending migrations, each in its own transaction.
+func migrate(db *bolt.DB) error {
+	return migrateTo(db, migrations)
+}
+
+func migrateTo(db *bolt.DB, migrations []func(tx *bolt.Tx) error) error {
+	for {
+		done := false
+		err := db.Update(func(tx *bolt.Tx) error {
+			version := schemaVersion(tx)
+			if version > len(migrations) {
+				return fmt.Errorf("schema version %d is newer than this server supports (%d)", version, len(migrations))
+			}
+			if version == len(migrations) {
+				done = true
+				return nil
+			}
+			if err := migrations[version](tx); err != nil {
+				return fmt.Errorf("migration %d: %w", version+1, err)
+			}
+			meta, err := tx.CreateBucketIfNotExists(bucketMeta)
+			if err != nil {
+				return err
+			}
+			return meta.Put(keySchemaVersion, binary.BigEndian.AppendUint64(nil, uint64(version+1)))
+		})
+		if err != nil || done {
+			return err
+		}
+	}
+}
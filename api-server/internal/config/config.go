@@ -0,0 +1,478 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"AnimeFrameBot/internal/logging"
+	"AnimeFrameBot/internal/storage"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Rate struct {
+	PerSecond float64 `yaml:"per_second"`
+	Burst     int     `yaml:"burst"`
+}
+
+type RateLimit struct {
+	Search     Rate  `yaml:"search"`
+	Download   Rate  `yaml:"download"`
+	Upload     Rate  `yaml:"upload"`
+	Chunk      Rate  `yaml:"chunk"`
+	QuotaBytes int64 `yaml:"quota_bytes"`
+	QuotaCount int   `yaml:"quota_count"`
+}
+
+type S3 struct {
+	Endpoint        string        `yaml:"endpoint"`
+	Region          string        `yaml:"region"`
+	Bucket          string        `yaml:"bucket"`
+	Prefix          string        `yaml:"prefix"`
+	AccessKeyID     string        `yaml:"access_key_id"`
+	SecretAccessKey string        `yaml:"secret_access_key"`
+	PartSize        int64         `yaml:"part_size"`
+	PresignExpiry   time.Duration `yaml:"presign_expiry"`
+}
+
+// Import configures fetching images from URLs for POST /frame/import.
+type Import struct {
+	Timeout time.Duration `yaml:"timeout"`
+	// AllowPrivate allows fetching from loopback, private and link-local
+	// addresses, which are blocked to protect internal services.
+	AllowPrivate bool `yaml:"allow_private"`
+}
+
+// Resumable configures the staging of resumable uploads.
+type Resumable struct {
+	Dir    string        `yaml:"dir"`
+	Expiry time.Duration `yaml:"expiry"`
+}
+
+// Image limits the images accepted for upload.
+type Image struct {
+	// MaxPixels and MaxSide bound the dimensions of images, which are checked
+	// before decoding them.
+	MaxPixels int64 `yaml:"max_pixels"`
+	MaxSide   int   `yaml:"max_side"`
+	// Reencode stores uploads decoded and encoded again instead of as sent.
+	Reencode bool `yaml:"reencode"`
+}
+
+// Shuffle configures the sessions of random searches that return every frame
+// once before repeating any.
+type Shuffle struct {
+	SessionTTL  time.Duration `yaml:"session_ttl"`
+	MaxSessions int           `yaml:"max_sessions"`
+}
+
+// Daily configures the frame of the day.
+type Daily struct {
+	// ExcludeDays is how many days a picked frame is not picked again.
+	ExcludeDays int `yaml:"exclude_days"`
+}
+
+// Auth configures authentication.
+type Auth struct {
+	// Disabled serves every route but the admin routes without API keys
+	// when there is no keys file.
+	Disabled bool `yaml:"disabled"`
+}
+
+// Stats configures the usage statistics.
+type Stats struct {
+	// FlushInterval is how often the counts are written to the catalog.
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+type Features struct {
+	Upload    bool `yaml:"upload"`
+	Metrics   bool `yaml:"metrics"`
+	RateLimit bool `yaml:"rate_limit"`
+}
+
+type Config struct {
+	Addr              string        `yaml:"addr"`
+	TLSCert           string        `yaml:"tls_cert"`
+	TLSKey            string        `yaml:"tls_key"`
+	TLSReloadInterval time.Duration `yaml:"tls_reload_interval"`
+	Storage           string        `yaml:"storage"`
+	ImageDir          string        `yaml:"image_dir"`
+	S3                S3            `yaml:"s3"`
+	CatalogFile       string        `yaml:"catalog_file"`
+	KeysFile          string        `yaml:"keys_file"`
+	Auth              Auth          `yaml:"auth"`
+	LogLevel          string        `yaml:"log_level"`
+	MaxUploadBytes    int64         `yaml:"max_upload_bytes"`
+	MaxBatchBytes     int64         `yaml:"max_batch_bytes"`
+	Import            Import        `yaml:"import"`
+	Resumable         Resumable     `yaml:"resumable"`
+	Image             Image         `yaml:"image"`
+	MaxCount          int           `yaml:"max_count"`
+	MaxBundleBytes    int64         `yaml:"max_bundle_bytes"`
+	Shuffle           Shuffle       `yaml:"shuffle"`
+	Daily             Daily         `yaml:"daily"`
+	Stats             Stats         `yaml:"stats"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"`
+	MinFreeBytes      int64         `yaml:"min_free_bytes"`
+	RateLimit         RateLimit     `yaml:"rate_limit"`
+	Features          Features      `yaml:"features"`
+}
+
+func Default() *Config {
+	return &Config{
+		Addr:              ":8763",
+		TLSReloadInterval: time.Minute,
+		Storage:           "local",
+		ImageDir:          "images",
+		S3: S3{
+			Region:   "us-east-1",
+			PartSize: 16 << 20,
+		},
+		LogLevel:       "info",
+		MaxUploadBytes: 10 << 20,
+		MaxBatchBytes:  512 << 20,
+		Import:         Import{Timeout: 10 * time.Second},
+		Resumable: Resumable{
+			Dir:    filepath.Join(os.TempDir(), "animeframebot-uploads"),
+			Expiry: 24 * time.Hour,
+		},
+		Image:           Image{MaxPixels: 25_000_000, MaxSide: 16384},
+		MaxCount:        10,
+		MaxBundleBytes:  20 << 20,
+		Shuffle:         Shuffle{SessionTTL: time.Hour, MaxSessions: 10000},
+		Daily:           Daily{ExcludeDays: 30},
+		Stats:           Stats{FlushInterval: time.Minute},
+		ShutdownTimeout: 10 * time.Second,
+		MinFreeBytes:    100 << 20,
+		RateLimit: RateLimit{
+			Search:     Rate{PerSecond: 2, Burst: 10},
+			Download:   Rate{PerSecond: 10, Burst: 30},
+			Upload:     Rate{PerSecond: 0.2, Burst: 5},
+			Chunk:      Rate{PerSecond: 5, Burst: 20},
+			QuotaBytes: 500 << 20,
+			QuotaCount: 200,
+		},
+		Features: Features{
+			Upload:    true,
+			Metrics:   true,
+			RateLimit: true,
+		},
+	}
+}
+
+// setting is one option that can be given as a flag or as an environment
+// variable. The variable name is the flag name in upper case with an API_ prefix.
+type setting struct {
+	name  string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+func (s setting) env() string {
+	return "API_" + strings.ToUpper(strings.ReplaceAll(s.name, "-", "_"))
+}
+
+func setString(field func(c *Config) *string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func setInt(field func(c *Config) *int) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func setInt64(field func(c *Config) *int64) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func setFloat(field func(c *Config) *float64) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		*field(c) = f
+		return nil
+	}
+}
+
+func setBool(field func(c *Config) *bool) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+func setDuration(field func(c *Config) *time.Duration) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+var settings = []setting{
+	{"addr", "listen address, or unix:/path/to/socket", setString(func(c *Config) *string { return &c.Addr })},
+	{"tls-cert", "TLS certificate file, enables HTTPS together with -tls-key", setString(func(c *Config) *string { return &c.TLSCert })},
+	{"tls-key", "TLS private key file", setString(func(c *Config) *string { return &c.TLSKey })},
+	{"tls-reload-interval", "how often to check the TLS files for changes", setDuration(func(c *Config) *time.Duration { return &c.TLSReloadInterval })},
+	{"storage", "where frames are stored: local or s3", setString(func(c *Config) *string { return &c.Storage })},
+	{"image-dir", "directory of the anime frames with local storage", setString(func(c *Config) *string { return &c.ImageDir })},
+	{"s3-endpoint", "URL of the S3-compatible object store", setString(func(c *Config) *string { return &c.S3.Endpoint })},
+	{"s3-region", "region of the bucket", setString(func(c *Config) *string { return &c.S3.Region })},
+	{"s3-bucket", "bucket of the anime frames", setString(func(c *Config) *string { return &c.S3.Bucket })},
+	{"s3-prefix", "prefix of the frame keys in the bucket, e.g. frames/", setString(func(c *Config) *string { return &c.S3.Prefix })},
+	{"s3-access-key-id", "access key ID for the object store", setString(func(c *Config) *string { return &c.S3.AccessKeyID })},
+	{"s3-secret-access-key", "secret access key for the object store", setString(func(c *Config) *string { return &c.S3.SecretAccessKey })},
+	{"s3-part-size", "part size of multipart uploads, at least 5 MiB", setInt64(func(c *Config) *int64 { return &c.S3.PartSize })},
+	{"s3-presign-expiry", "validity of presigned download URLs, 0 to proxy downloads", setDuration(func(c *Config) *time.Duration { return &c.S3.PresignExpiry })},
+	{"catalog-file", "bbolt database of frame metadata, the catalog is disabled without it", setString(func(c *Config) *string { return &c.CatalogFile })},
+	{"keys-file", "JSON file of API keys, required unless -auth-disabled is set", setString(func(c *Config) *string { return &c.KeysFile })},
+	{"auth-disabled", "serve without API keys, leaving uploads open to anyone and the admin routes off", setBool(func(c *Config) *bool { return &c.Auth.Disabled })},
+	{"log-level", "debug, info, warn or error", setString(func(c *Config) *string { return &c.LogLevel })},
+	{"max-upload-bytes", "maximum size of an uploaded image", setInt64(func(c *Config) *int64 { return &c.MaxUploadBytes })},
+	{"max-batch-bytes", "maximum size of a batch upload request", setInt64(func(c *Config) *int64 { return &c.MaxBatchBytes })},
+	{"import-timeout", "time limit for fetching an image to import", setDuration(func(c *Config) *time.Duration { return &c.Import.Timeout })},
+	{"import-allow-private", "allow importing images from private and loopback addresses", setBool(func(c *Config) *bool { return &c.Import.AllowPrivate })},
+	{"resumable-dir", "directory staging resumable uploads until they are finalized", setString(func(c *Config) *string { return &c.Resumable.Dir })},
+	{"resumable-expiry", "time after which unfinished resumable uploads are removed", setDuration(func(c *Config) *time.Duration { return &c.Resumable.Expiry })},
+	{"image-max-pixels", "maximum number of pixels of an uploaded image", setInt64(func(c *Config) *int64 { return &c.Image.MaxPixels })},
+	{"image-max-side", "maximum width and height of an uploaded image", setInt(func(c *Config) *int { return &c.Image.MaxSide })},
+	{"image-reencode", "store uploaded images re-encoded instead of as sent", setBool(func(c *Config) *bool { return &c.Image.Reencode })},
+	{"max-count", "maximum number of frames returned per request", setInt(func(c *Config) *int { return &c.MaxCount })},
+	{"max-bundle-bytes", "maximum size of the images returned with a search", setInt64(func(c *Config) *int64 { return &c.MaxBundleBytes })},
+	{"shuffle-session-ttl", "time after which unused shuffle sessions are forgotten", setDuration(func(c *Config) *time.Duration { return &c.Shuffle.SessionTTL })},
+	{"shuffle-max-sessions", "maximum number of shuffle sessions kept", setInt(func(c *Config) *int { return &c.Shuffle.MaxSessions })},
+	{"daily-exclude-days", "days before the frame of the day may be picked again", setInt(func(c *Config) *int { return &c.Daily.ExcludeDays })},
+	{"stats-flush-interval", "how often usage statistics are written to the catalog", setDuration(func(c *Config) *time.Duration { return &c.Stats.FlushInterval })},
+	{"shutdown-timeout", "time to wait for in-flight requests on shutdown", setDuration(func(c *Config) *time.Duration { return &c.ShutdownTimeout })},
+	{"min-free-bytes", "free disk space below which /readyz fails", setInt64(func(c *Config) *int64 { return &c.MinFreeBytes })},
+	{"search-rate", "searches per second per client", setFloat(func(c *Config) *float64 { return &c.RateLimit.Search.PerSecond })},
+	{"search-burst", "search burst per client", setInt(func(c *Config) *int { return &c.RateLimit.Search.Burst })},
+	{"download-rate", "downloads per second per client", setFloat(func(c *Config) *float64 { return &c.RateLimit.Download.PerSecond })},
+	{"download-burst", "download burst per client", setInt(func(c *Config) *int { return &c.RateLimit.Download.Burst })},
+	{"upload-rate", "uploads per second per client", setFloat(func(c *Config) *float64 { return &c.RateLimit.Upload.PerSecond })},
+	{"upload-burst", "upload burst per client", setInt(func(c *Config) *int { return &c.RateLimit.Upload.Burst })},
+	{"chunk-rate", "resumable upload requests per second per client", setFloat(func(c *Config) *float64 { return &c.RateLimit.Chunk.PerSecond })},
+	{"chunk-burst", "resumable upload request burst per client", setInt(func(c *Config) *int { return &c.RateLimit.Chunk.Burst })},
+	{"quota-bytes", "uploaded bytes per client per day, 0 for unlimited", setInt64(func(c *Config) *int64 { return &c.RateLimit.QuotaBytes })},
+	{"quota-count", "uploads per client per day, 0 for unlimited", setInt(func(c *Config) *int { return &c.RateLimit.QuotaCount })},
+	{"feature-upload", "enable POST /frame", setBool(func(c *Config) *bool { return &c.Features.Upload })},
+	{"feature-metrics", "enable GET /metrics", setBool(func(c *Config) *bool { return &c.Features.Metrics })},
+	{"feature-rate-limit", "enable rate limiting and upload quotas", setBool(func(c *Config) *bool { return &c.Features.RateLimit })},
+}
+
+// Load builds the configuration from, in increasing order of precedence, the
+// defaults, the YAML file named by -config or API_CONFIG, environment
+// variables and command line flags. The result is validated.
+func Load(args []string, getenv func(string) string, output io.Writer) (*Config, error) {
+	fs := flag.NewFlagSet("api-server", flag.ContinueOnError)
+	fs.SetOutput(output)
+	configFile := fs.String("config", getenv("API_CONFIG"), "YAML configuration file (env API_CONFIG)")
+
+	type flagValue struct {
+		setting setting
+		value   string
+	}
+	var flagValues []flagValue
+	for _, s := range settings {
+		fs.Func(s.name, fmt.Sprintf("%s (env %s)", s.usage, s.env()), func(value string) error {
+			if err := s.set(Default(), value); err != nil {
+				return err
+			}
+			flagValues = append(flagValues, flagValue{setting: s, value: value})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range settings {
+		if value := getenv(s.env()); value != "" {
+			if err := s.set(cfg, value); err != nil {
+				return nil, fmt.Errorf("%s: %w", s.env(), err)
+			}
+		}
+	}
+	for _, fv := range flagValues {
+		if err := fv.setting.set(cfg, fv.value); err != nil {
+			return nil, fmt.Errorf("-%s: %w", fv.setting.name, err)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks that the configuration is usable, including that the image
+// directory exists with local storage.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Addr == "" {
+		errs = append(errs, errors.New("addr must not be empty"))
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, errors.New("tls_cert and tls_key must be set together"))
+	}
+	if c.TLSCert != "" && c.TLSReloadInterval <= 0 {
+		errs = append(errs, fmt.Errorf("tls_reload_interval must be positive, got %s", c.TLSReloadInterval))
+	}
+	if c.KeysFile == "" && !c.Auth.Disabled {
+		errs = append(errs, errors.New("keys_file is required, or auth.disabled to serve without authentication"))
+	}
+	switch c.Storage {
+	case "local":
+		if info, err := os.Stat(c.ImageDir); err != nil {
+			errs = append(errs, fmt.Errorf("image_dir: %w", err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("image_dir: %s is not a directory", c.ImageDir))
+		}
+	case "s3":
+		errs = append(errs, c.S3.validate()...)
+	default:
+		errs = append(errs, fmt.Errorf("storage must be local or s3, got %q", c.Storage))
+	}
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("log_level: %w", err))
+	}
+	if c.MaxUploadBytes <= 0 {
+		errs = append(errs, fmt.Errorf("max_upload_bytes must be positive, got %d", c.MaxUploadBytes))
+	}
+	if c.MaxBatchBytes <= 0 {
+		errs = append(errs, fmt.Errorf("max_batch_bytes must be positive, got %d", c.MaxBatchBytes))
+	}
+	if c.Import.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("import.timeout must be positive, got %s", c.Import.Timeout))
+	}
+	if c.Resumable.Dir == "" {
+		errs = append(errs, errors.New("resumable.dir is required"))
+	}
+	if c.Resumable.Expiry <= 0 {
+		errs = append(errs, fmt.Errorf("resumable.expiry must be positive, got %s", c.Resumable.Expiry))
+	}
+	if c.Image.MaxPixels <= 0 {
+		errs = append(errs, fmt.Errorf("image.max_pixels must be positive, got %d", c.Image.MaxPixels))
+	}
+	if c.Image.MaxSide <= 0 {
+		errs = append(errs, fmt.Errorf("image.max_side must be positive, got %d", c.Image.MaxSide))
+	}
+	if c.MaxCount <= 0 {
+		errs = append(errs, fmt.Errorf("max_count must be positive, got %d", c.MaxCount))
+	}
+	if c.MaxBundleBytes <= 0 {
+		errs = append(errs, fmt.Errorf("max_bundle_bytes must be positive, got %d", c.MaxBundleBytes))
+	}
+	if c.Shuffle.SessionTTL <= 0 {
+		errs = append(errs, fmt.Errorf("shuffle.session_ttl must be positive, got %s", c.Shuffle.SessionTTL))
+	}
+	if c.Shuffle.MaxSessions <= 0 {
+		errs = append(errs, fmt.Errorf("shuffle.max_sessions must be positive, got %d", c.Shuffle.MaxSessions))
+	}
+	if c.Daily.ExcludeDays < 0 {
+		errs = append(errs, fmt.Errorf("daily.exclude_days must not be negative, got %d", c.Daily.ExcludeDays))
+	}
+	if c.Stats.FlushInterval <= 0 {
+		errs = append(errs, fmt.Errorf("stats.flush_interval must be positive, got %s", c.Stats.FlushInterval))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("shutdown_timeout must be positive, got %s", c.ShutdownTimeout))
+	}
+	if c.MinFreeBytes < 0 {
+		errs = append(errs, fmt.Errorf("min_free_bytes must not be negative, got %d", c.MinFreeBytes))
+	}
+	if c.Features.RateLimit {
+		rates := []struct {
+			name string
+			rate Rate
+		}{
+			{"search", c.RateLimit.Search},
+			{"download", c.RateLimit.Download},
+			{"upload", c.RateLimit.Upload},
+			{"chunk", c.RateLimit.Chunk},
+		}
+		for _, r := range rates {
+			if r.rate.PerSecond <= 0 || r.rate.Burst < 1 {
+				errs = append(errs, fmt.Errorf("rate_limit.%s needs a positive rate and burst, got %g/s burst %d", r.name, r.rate.PerSecond, r.rate.Burst))
+			}
+		}
+		if c.RateLimit.QuotaBytes < 0 || c.RateLimit.QuotaCount < 0 {
+			errs = append(errs, errors.New("rate_limit quotas must not be negative"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s S3) validate() []error {
+	var errs []error
+	if u, err := url.Parse(s.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("s3.endpoint must be an http or https URL, got %q", s.Endpoint))
+	}
+	if s.Region == "" || s.Bucket == "" {
+		errs = append(errs, errors.New("s3.region and s3.bucket must not be empty"))
+	}
+	if s.AccessKeyID == "" || s.SecretAccessKey == "" {
+		errs = append(errs, errors.New("s3.access_key_id and s3.secret_access_key must not be empty"))
+	}
+	if s.PartSize < storage.MinPartSize {
+		errs = append(errs, fmt.Errorf("s3.part_size must be at least %d, got %d", storage.MinPartSize, s.PartSize))
+	}
+	if s.PresignExpiry < 0 || s.PresignExpiry > 7*24*time.Hour {
+		errs = append(errs, fmt.Errorf("s3.presign_expiry must be between 0s and 168h, got %s", s.PresignExpiry))
+	}
+	return errs
+}
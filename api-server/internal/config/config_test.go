@@ -0,0 +1,316 @@
+package config
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func envMap(env map[string]string) func(string) string {
+	return func(key string) string {
+		return env[key]
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	imageDir := t.TempDir()
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configFile, []byte(`
+addr: ":9000"
+image_dir: "`+imageDir+`"
+keys_file: "keys.json"
+max_count: 20
+shutdown_timeout: 30s
+rate_limit:
+  search:
+    per_second: 5
+    burst: 50
+features:
+  metrics: false
+`), 0o644)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		args   []string
+		env    map[string]string
+		expect func(t *testing.T, cfg *Config)
+	}{
+		{
+			name: "file",
+			args: []string{"-config", configFile},
+			expect: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, ":9000", cfg.Addr)
+				assert.Equal(t, imageDir, cfg.ImageDir)
+				assert.Equal(t, "keys.json", cfg.KeysFile)
+				assert.Equal(t, 20, cfg.MaxCount)
+				assert.Equal(t, 30*time.Second, cfg.ShutdownTimeout)
+				assert.Equal(t, Rate{PerSecond: 5, Burst: 50}, cfg.RateLimit.Search)
+				assert.False(t, cfg.Features.Metrics)
+				// Options missing from the file keep their defaults.
+				assert.Equal(t, int64(10<<20), cfg.MaxUploadBytes)
+				assert.Equal(t, int64(512<<20), cfg.MaxBatchBytes)
+				assert.Equal(t, Default().RateLimit.Download, cfg.RateLimit.Download)
+				assert.True(t, cfg.Features.Upload)
+			},
+		},
+		{
+			name: "env overrides file",
+			env: map[string]string{
+				"API_CONFIG":          configFile,
+				"API_ADDR":            ":9001",
+				"API_MAX_COUNT":       "5",
+				"API_FEATURE_METRICS": "true",
+			},
+			expect: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, ":9001", cfg.Addr)
+				assert.Equal(t, 5, cfg.MaxCount)
+				assert.True(t, cfg.Features.Metrics)
+				assert.Equal(t, 30*time.Second, cfg.ShutdownTimeout)
+			},
+		},
+		{
+			name: "flags override env",
+			args: []string{"-config", configFile, "-addr", ":9002", "-max-upload-bytes", "1024", "-feature-upload=false", "-import-allow-private=true", "-image-reencode=true"},
+			env:  map[string]string{"API_ADDR": ":9001", "API_MAX_UPLOAD_BYTES": "2048", "API_IMPORT_TIMEOUT": "3s", "API_SHUFFLE_SESSION_TTL": "5m"},
+			expect: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, ":9002", cfg.Addr)
+				assert.Equal(t, int64(1024), cfg.MaxUploadBytes)
+				assert.False(t, cfg.Features.Upload)
+				assert.True(t, cfg.Import.AllowPrivate)
+				assert.Equal(t, 3*time.Second, cfg.Import.Timeout)
+				assert.Equal(t, 24*time.Hour, cfg.Resumable.Expiry)
+				assert.True(t, cfg.Image.Reencode)
+				assert.Equal(t, int64(25_000_000), cfg.Image.MaxPixels)
+				assert.Equal(t, 5*time.Minute, cfg.Shuffle.SessionTTL)
+				assert.Equal(t, 10000, cfg.Shuffle.MaxSessions)
+			},
+		},
+		{
+			name: "s3 from env",
+			env: map[string]string{
+				"API_STORAGE":              "s3",
+				"API_S3_ENDPOINT":          "https://s3.eu-central-1.amazonaws.com",
+				"API_S3_REGION":            "eu-central-1",
+				"API_S3_BUCKET":            "frames",
+				"API_S3_ACCESS_KEY_ID":     "id",
+				"API_S3_SECRET_ACCESS_KEY": "secret",
+				"API_S3_PRESIGN_EXPIRY":    "15m",
+				"API_KEYS_FILE":            "keys.json",
+			},
+			expect: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, "s3", cfg.Storage)
+				assert.Equal(t, "frames", cfg.S3.Bucket)
+				assert.Equal(t, "secret", cfg.S3.SecretAccessKey)
+				assert.Equal(t, 15*time.Minute, cfg.S3.PresignExpiry)
+				assert.Equal(t, int64(16<<20), cfg.S3.PartSize)
+			},
+		},
+		{
+			name: "env only",
+			env:  map[string]string{"API_IMAGE_DIR": imageDir, "API_SEARCH_RATE": "0.5", "API_LOG_LEVEL": "debug", "API_AUTH_DISABLED": "true"},
+			expect: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, ":8763", cfg.Addr)
+				assert.True(t, cfg.Auth.Disabled)
+				assert.Equal(t, imageDir, cfg.ImageDir)
+				assert.Equal(t, 0.5, cfg.RateLimit.Search.PerSecond)
+				assert.Equal(t, "debug", cfg.LogLevel)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Load(tt.args, envMap(tt.env), io.Discard)
+			require.NoError(t, err)
+			tt.expect(t, cfg)
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	imageDir := t.TempDir()
+	badFile := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(badFile, []byte("unknown_option: 1\n"), 0o644)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		args        []string
+		env         map[string]string
+		expectError string
+	}{
+		{
+			name:        "bad flag value",
+			args:        []string{"-image-dir", imageDir, "-max-count", "many"},
+			expectError: `invalid value "many" for flag -max-count: strconv.Atoi: parsing "many": invalid syntax`,
+		},
+		{
+			name:        "bad env value",
+			env:         map[string]string{"API_IMAGE_DIR": imageDir, "API_SHUTDOWN_TIMEOUT": "soon"},
+			expectError: `API_SHUTDOWN_TIMEOUT: time: invalid duration "soon"`,
+		},
+		{
+			name:        "missing config file",
+			args:        []string{"-config", filepath.Join(imageDir, "nonexistent.yaml")},
+			expectError: "open " + filepath.Join(imageDir, "nonexistent.yaml") + ": no such file or directory",
+		},
+		{
+			name:        "unknown option in file",
+			args:        []string{"-config", badFile},
+			expectError: "parse " + badFile + ": yaml: unmarshal errors:\n  line 1: field unknown_option not found in type config.Config",
+		},
+		{
+			name:        "missing image dir",
+			args:        []string{"-image-dir", filepath.Join(imageDir, "nonexistent"), "-auth-disabled=true"},
+			expectError: "image_dir: stat " + filepath.Join(imageDir, "nonexistent") + ": no such file or directory",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(tt.args, envMap(tt.env), io.Discard)
+			assert.EqualError(t, err, tt.expectError)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	imageDir := t.TempDir()
+	file := filepath.Join(imageDir, "file")
+	err := os.WriteFile(file, nil, 0o644)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		modify      func(c *Config)
+		expectError string
+	}{
+		{
+			name:   "valid",
+			modify: func(c *Config) {},
+		},
+		{
+			name:        "no keys file",
+			modify:      func(c *Config) { c.KeysFile = "" },
+			expectError: "keys_file is required, or auth.disabled to serve without authentication",
+		},
+		{
+			name:   "authentication disabled",
+			modify: func(c *Config) { c.KeysFile = ""; c.Auth.Disabled = true },
+		},
+		{
+			name:        "empty addr",
+			modify:      func(c *Config) { c.Addr = "" },
+			expectError: "addr must not be empty",
+		},
+		{
+			name:        "tls cert without key",
+			modify:      func(c *Config) { c.TLSCert = "cert.pem" },
+			expectError: "tls_cert and tls_key must be set together",
+		},
+		{
+			name:        "tls without reload interval",
+			modify:      func(c *Config) { c.TLSCert = "cert.pem"; c.TLSKey = "key.pem"; c.TLSReloadInterval = 0 },
+			expectError: "tls_reload_interval must be positive, got 0s",
+		},
+		{
+			name:        "image dir is a file",
+			modify:      func(c *Config) { c.ImageDir = file },
+			expectError: "image_dir: " + file + " is not a directory",
+		},
+		{
+			name:        "bad log level",
+			modify:      func(c *Config) { c.LogLevel = "loud" },
+			expectError: `log_level: invalid log level: "loud"`,
+		},
+		{
+			name: "non-positive limits",
+			modify: func(c *Config) {
+				c.MaxUploadBytes = 0
+				c.MaxBatchBytes = 0
+				c.Import.Timeout = 0
+				c.Resumable.Expiry = 0
+				c.Image.MaxPixels = 0
+				c.Image.MaxSide = 0
+				c.MaxCount = -1
+				c.MaxBundleBytes = 0
+				c.Shuffle.SessionTTL = 0
+				c.Shuffle.MaxSessions = 0
+				c.Stats.FlushInterval = 0
+				c.ShutdownTimeout = 0
+			},
+			expectError: "max_upload_bytes must be positive, got 0\nmax_batch_bytes must be positive, got 0\nimport.timeout must be positive, got 0s\nresumable.expiry must be positive, got 0s\nimage.max_pixels must be positive, got 0\nimage.max_side must be positive, got 0\nmax_count must be positive, got -1\nmax_bundle_bytes must be positive, got 0\nshuffle.session_ttl must be positive, got 0s\nshuffle.max_sessions must be positive, got 0\nstats.flush_interval must be positive, got 0s\nshutdown_timeout must be positive, got 0s",
+		},
+		{
+			name:        "bad rate",
+			modify:      func(c *Config) { c.RateLimit.Upload.Burst = 0 },
+			expectError: "rate_limit.upload needs a positive rate and burst, got 0.2/s burst 0",
+		},
+		{
+			name:   "bad rate with rate limit disabled",
+			modify: func(c *Config) { c.RateLimit.Upload.Burst = 0; c.Features.RateLimit = false },
+		},
+		{
+			name:        "unknown storage",
+			modify:      func(c *Config) { c.Storage = "ftp" },
+			expectError: `storage must be local or s3, got "ftp"`,
+		},
+		{
+			name: "s3 storage",
+			modify: func(c *Config) {
+				c.Storage = "s3"
+				c.ImageDir = "nonexistent"
+				c.S3 = S3{Endpoint: "http://minio:9000", Region: "us-east-1", Bucket: "frames", AccessKeyID: "id", SecretAccessKey: "secret", PartSize: 5 << 20}
+			},
+		},
+		{
+			name: "incomplete s3 storage",
+			modify: func(c *Config) {
+				c.Storage = "s3"
+				c.S3.Endpoint = "minio:9000"
+				c.S3.PartSize = 1
+				c.S3.PresignExpiry = -time.Second
+			},
+			expectError: `s3.endpoint must be an http or https URL, got "minio:9000"` +
+				"\ns3.region and s3.bucket must not be empty" +
+				"\ns3.access_key_id and s3.secret_access_key must not be empty" +
+				"\ns3.part_size must be at least 5242880, got 1" +
+				"\ns3.presign_expiry must be between 0s and 168h, got -1s",
+		},
+		{
+			name:        "negative quota",
+			modify:      func(c *Config) { c.RateLimit.QuotaCount = -1 },
+			expectError: "rate_limit quotas must not be negative",
+		},
+		{
+			name:        "negative daily exclusion",
+			modify:      func(c *Config) { c.Daily.ExcludeDays = -1 },
+			expectError: "daily.exclude_days must not be negative, got -1",
+		},
+		{
+			name:   "daily picks may repeat",
+			modify: func(c *Config) { c.Daily.ExcludeDays = 0 },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			cfg.ImageDir = imageDir
+			cfg.KeysFile = "keys.json"
+			tt.modify(cfg)
+			err := cfg.Validate()
+			if tt.expectError != "" {
+				assert.EqualError(t, err, tt.expectError)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package frame
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/rand"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// seriesTagPrefix starts the catalog tags naming the series of a frame.
+const seriesTagPrefix = "series:"
+
+// Daily picks a frame per day. The pick only depends on the date, the scope
+// and the frames, so it stays the same across restarts.
+//
+// With a catalog, picks are recorded there: a frame picked in the last
+// excludeDays days of a scope is not picked again while others are left, and
+// the pick of the day stays the same when frames are added. Without one, the
+// frames a pick among all frames gives on each of the last excludeDays days
+// are excluded instead, which only depends on the frames as well.
+type Daily struct {
+	index       *Index
+	excludeDays int
+	now         func() time.Time
+}
+
+// NewDaily returns a daily picker of the frames in index.
+func NewDaily(index *Index, excludeDays int) *Daily {
+	return &Daily{index: index, excludeDays: excludeDays, now: time.Now}
+}
+
+// Pick returns the frame of the current UTC day for a chat, among the frames
+// tagged with series. Either may be "" for all. It returns false if there is
+// no frame to pick from.
+func (d *Daily) Pick(ctx context.Context, series, chat string) (Frame, bool, error) {
+	frames, err := d.index.Frames(ctx)
+	if err != nil {
+		return Frame{}, false, err
+	}
+	if series != "" {
+		frames, _ = filterFrames(frames, nil, func(f Frame) bool {
+			return slices.Contains(f.Tags, seriesTagPrefix+series)
+		})
+	}
+	if len(frames) == 0 {
+		return Frame{}, false, nil
+	}
+
+	scope := url.Values{"series": {series}, "chat": {chat}}.Encode()
+	today := d.now().UTC()
+	date := today.Format(time.DateOnly)
+	cat := d.index.catalog
+	if cat == nil {
+		recent := make(map[string]bool, d.excludeDays)
+		for i := 1; i <= d.excludeDays; i++ {
+			day := today.AddDate(0, 0, -i).Format(time.DateOnly)
+			recent[pickDaily(frames, scope, day).Filename] = true
+		}
+		return pickDaily(excludeRecent(frames, recent), scope, date), true, nil
+	}
+
+	first := today.AddDate(0, 0, -d.excludeDays).Format(time.DateOnly)
+	picks, err := cat.DailyPicks(scope, first, date)
+	if err != nil {
+		return Frame{}, false, err
+	}
+	old := picks[date]
+	if i := slices.IndexFunc(frames, func(f Frame) bool { return f.Filename == old }); i >= 0 {
+		return frames[i], true, nil
+	}
+
+	recent := make(map[string]bool, len(picks))
+	for _, name := range picks {
+		recent[name] = true
+	}
+	picked := pickDaily(excludeRecent(frames, recent), scope, date)
+	recorded, err := cat.SetDailyPick(scope, date, old, picked.Filename)
+	if err != nil {
+		return Frame{}, false, err
+	}
+	if i := slices.IndexFunc(frames, func(f Frame) bool { return f.Filename == recorded }); i >= 0 {
+		return frames[i], true, nil
+	}
+	return picked, true, nil
+}
+
+// excludeRecent returns the frames that are not recent, or all frames if
+// every one is.
+func excludeRecent(frames []Frame, recent map[string]bool) []Frame {
+	candidates, _ := filterFrames(frames, nil, func(f Frame) bool { return !recent[f.Filename] })
+	if len(candidates) == 0 {
+		return frames
+	}
+	return candidates
+}
+
+// pickDaily picks one of frames with a random source seeded by scope and date.
+func pickDaily(frames []Frame, scope, date string) Frame {
+	sum := sha256.Sum256([]byte(scope + "\x00" + date))
+	rng := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(sum[:]))))
+	return frames[rng.Intn(len(frames))]
+}
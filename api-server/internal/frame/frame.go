@@ -1,22 +1,43 @@
 package frame
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"log/slog"
 	"math/rand"
-	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
+
+	"AnimeFrameBot/internal/catalog"
+	"AnimeFrameBot/internal/metrics"
+	"AnimeFrameBot/internal/storage"
 
 	"github.com/lithammer/fuzzysearch/fuzzy"
 )
 
+var indexFrames = metrics.NewGauge("frame_index_frames", "Number of frames found by the last scan of the storage backend.")
+
+// Frame is a frame as returned by searches. Size is the size of the stored
+// file. Width, Height, Format and Colors describe the image as recorded in the
+// catalog, and are left out without one.
+//
+// AddedAt and Tags are used to weight random picks and are not returned.
+// Without a catalog, AddedAt is the modification time of the stored file.
 type Frame struct {
-	Filename string `json:"name"`
-	Subtitle string `json:"subtitle"`
+	Filename string    `json:"name"`
+	Subtitle string    `json:"subtitle"`
+	Size     int64     `json:"size"`
+	Width    int       `json:"width,omitempty"`
+	Height   int       `json:"height,omitempty"`
+	Format   string    `json:"format,omitempty"`
+	Colors   []string  `json:"colors,omitempty"`
+	AddedAt  time.Time `json:"-"`
+	Tags     []string  `json:"-"`
 }
 
 type FrameDistance struct {
@@ -32,7 +53,8 @@ func extractSubtitle(fileName string) string {
 	return fileName
 }
 
-func isValidFileName(filename string) bool {
+// IsValidFileName reports whether filename has the form "<subtitle>_<sha256>.<ext>".
+func IsValidFileName(filename string) bool {
 	parts := strings.Split(filename, "_")
 	if len(parts) < 2 {
 		return false
@@ -55,9 +77,8 @@ func isValidFileName(filename string) bool {
 	return validExt
 }
 
-func renameFileWithHash(imageDir string, fileName string) (string, error) {
-	filePath := filepath.Join(imageDir, fileName)
-	file, err := os.Open(filePath)
+func renameFileWithHash(ctx context.Context, store storage.Backend, fileName string) (string, error) {
+	file, err := store.Open(ctx, fileName)
 	if err != nil {
 		return "", err
 	}
@@ -71,11 +92,11 @@ func renameFileWithHash(imageDir string, fileName string) (string, error) {
 	hash := sha256.Sum256(fileBytes)
 	hashString := hex.EncodeToString(hash[:])
 
-	ext := filepath.Ext(filePath)
-	baseName := strings.TrimSuffix(filepath.Base(filePath), ext)
+	ext := filepath.Ext(fileName)
+	baseName := strings.TrimSuffix(fileName, ext)
 	newFileName := baseName + "_" + hashString + ext
 
-	err = os.Rename(filePath, filepath.Join(imageDir, newFileName))
+	err = store.Rename(ctx, fileName, newFileName)
 	if err != nil {
 		return "", err
 	}
@@ -83,30 +104,85 @@ func renameFileWithHash(imageDir string, fileName string) (string, error) {
 	return newFileName, nil
 }
 
-func initFrames(imageDir string) ([]Frame, error) {
+// HashFromFileName returns the hash of a valid frame file name.
+func HashFromFileName(fileName string) string {
+	hashAndExt := fileName[strings.LastIndex(fileName, "_")+1:]
+	return strings.TrimSuffix(hashAndExt, filepath.Ext(hashAndExt))
+}
+
+func initFrames(ctx context.Context, store storage.Backend, cat *catalog.Catalog) ([]Frame, error) {
 	var frames []Frame
-	files, err := os.ReadDir(imageDir)
+	files, err := store.List(ctx, "")
 	if err != nil {
-		fmt.Println(err)
+		slog.ErrorContext(ctx, "list frames", "error", err)
 		return nil, err
 	}
 
+	// With a catalog, subtitles come from it. Frames missing from the catalog
+	// are added with the subtitle from their file name.
+	var cataloged map[string]catalog.Frame
+	var added []catalog.Frame
+	if cat != nil {
+		entries, err := cat.List()
+		if err != nil {
+			slog.ErrorContext(ctx, "list catalog", "error", err)
+			return nil, err
+		}
+		cataloged = make(map[string]catalog.Frame, len(entries))
+		for _, entry := range entries {
+			cataloged[entry.Name] = entry
+		}
+	}
+
 	for _, file := range files {
-		fileName := file.Name()
+		fileName := file.Name
+		// Hidden files such as .DS_Store or temporary files are not frames.
+		if strings.HasPrefix(fileName, ".") {
+			continue
+		}
 
-		if !isValidFileName(fileName) {
-			newFileName, err := renameFileWithHash(imageDir, fileName)
+		if !IsValidFileName(fileName) {
+			newFileName, err := renameFileWithHash(ctx, store, fileName)
 			if err != nil {
-				fmt.Println(err)
+				slog.ErrorContext(ctx, "rename frame with hash", "file", fileName, "error", err)
 				return nil, err
 			}
+			slog.InfoContext(ctx, "renamed frame with hash", "file", fileName, "new_file", newFileName)
 			fileName = newFileName
 		}
 
-		subtitle := extractSubtitle(fileName)
-		frames = append(frames, Frame{Filename: fileName, Subtitle: subtitle})
+		f := Frame{Filename: fileName, Subtitle: extractSubtitle(fileName), Size: file.Size, AddedAt: file.ModTime}
+		if cat != nil {
+			if entry, ok := cataloged[fileName]; ok {
+				f.Subtitle = entry.Subtitle
+				f.Width = entry.Width
+				f.Height = entry.Height
+				f.Format = entry.Format
+				f.Colors = entry.Colors
+				f.AddedAt = entry.AddedAt
+				f.Tags = entry.Tags
+			} else {
+				added = append(added, catalog.Frame{
+					Name:     fileName,
+					Hash:     HashFromFileName(fileName),
+					Subtitle: f.Subtitle,
+					Size:     file.Size,
+					AddedAt:  file.ModTime,
+				})
+			}
+		}
+		frames = append(frames, f)
 	}
 
+	if len(added) > 0 {
+		if err := cat.Put(added...); err != nil {
+			slog.ErrorContext(ctx, "add frames to catalog", "error", err)
+			return nil, err
+		}
+		slog.InfoContext(ctx, "added frames to catalog", "frames", len(added))
+	}
+
+	indexFrames.Set(float64(len(frames)))
 	return frames, nil
 }
 
@@ -143,7 +219,7 @@ func matchSubtitles(frames []Frame, input string, numFrames int) ([]Frame, error
 	return matchedFrames, nil
 }
 
-func matchSubtitlesExact(frames []Frame, input string, numFrames int) ([]Frame, error) {
+func matchSubtitlesExact(rng *rand.Rand, frames []Frame, input string, numFrames int) ([]Frame, error) {
 	if numFrames > len(frames) || numFrames < 0 {
 		return nil, fmt.Errorf("invalid number of frames: %d", numFrames)
 	}
@@ -162,16 +238,22 @@ func matchSubtitlesExact(frames []Frame, input string, numFrames int) ([]Frame,
 	if len(exactMatchedFrames) <= numFrames {
 		return exactMatchedFrames, nil
 	} else {
-		return getRandomFrames(exactMatchedFrames, numFrames)
+		return getRandomFrames(rng, exactMatchedFrames, numFrames)
 	}
 }
 
-func getRandomFrames(frames []Frame, numFrames int) ([]Frame, error) {
+// getRandomFrames picks numFrames distinct frames in random order. The same
+// rng and frames always give the same picks; a nil rng uses the global source.
+func getRandomFrames(rng *rand.Rand, frames []Frame, numFrames int) ([]Frame, error) {
 	if numFrames > len(frames) || numFrames < 0 {
 		return nil, fmt.Errorf("invalid number of frames: %d", numFrames)
 	}
 
-	randomIndices := rand.Perm(len(frames))[:numFrames]
+	perm := rand.Perm
+	if rng != nil {
+		perm = rng.Perm
+	}
+	randomIndices := perm(len(frames))[:numFrames]
 	randomFrames := []Frame{}
 	for _, index := range randomIndices {
 		randomFrames = append(randomFrames, frames[index])
@@ -1,13 +1,27 @@
 package frame
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"os"
+	"io"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"AnimeFrameBot/internal/catalog"
+	"AnimeFrameBot/internal/storage"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestUtf8len(t *testing.T) {
@@ -56,55 +70,55 @@ func TestIsValidFileName(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		assert.Equal(t, tt.expect, isValidFileName(tt.input))
+		assert.Equal(t, tt.expect, IsValidFileName(tt.input))
 	}
 }
 
 func TestRenameFileWithHash(t *testing.T) {
 	tests := []struct {
-		imageDir    string
 		fileName    string
+		exists      bool
+		expectName  string
 		expectError string
 	}{
 		{
-			imageDir: "test_images",
-			fileName: "a.png",
+			fileName:   "a.png",
+			exists:     true,
+			expectName: "a_e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855.png",
 		},
 		{
-			imageDir:    "nonexistent",
 			fileName:    "a.png",
-			expectError: "open nonexistent/a.png: no such file or directory",
+			expectError: "open a.png: file does not exist",
 		},
 	}
 
 	for _, tt := range tests {
-		if tt.imageDir != "nonexistent" {
-			err := os.Mkdir(tt.imageDir, 0o755)
-			assert.NoError(t, err)
-			f, err := os.Create(tt.imageDir + "/" + tt.fileName)
+		store := storage.NewMemory()
+		if tt.exists {
+			_, err := store.Put(context.Background(), tt.fileName, strings.NewReader(""))
 			assert.NoError(t, err)
-			f.Close()
 		}
 
-		_, err := renameFileWithHash(tt.imageDir, tt.fileName)
+		name, err := renameFileWithHash(context.Background(), store, tt.fileName)
 		if tt.expectError != "" {
 			assert.EqualError(t, err, tt.expectError)
 		} else {
 			assert.NoError(t, err)
-			e := os.RemoveAll(tt.imageDir)
-			assert.NoError(t, e)
+			assert.Equal(t, tt.expectName, name)
+			_, err = store.Stat(context.Background(), name)
+			assert.NoError(t, err)
 		}
 	}
 }
 
 func TestInitFrames(t *testing.T) {
 	tests := []struct {
-		imageDir     string
+		store        storage.Backend
 		expectFrames []Frame
 		expectError  string
 	}{
 		{
-			imageDir: "test_images",
+			store: storage.NewMemory(),
 			expectFrames: []Frame{
 				{Filename: "a.png", Subtitle: "a"},
 				{Filename: "b.png", Subtitle: "b"},
@@ -114,28 +128,23 @@ func TestInitFrames(t *testing.T) {
 			},
 		},
 		{
-			imageDir:    "nonexistent",
+			store:       storage.NewLocal("nonexistent"),
 			expectError: "open nonexistent: no such file or directory",
 		},
 	}
 
 	for _, tt := range tests {
-		if tt.imageDir != "nonexistent" {
-			err := os.Mkdir(tt.imageDir, 0o755)
-			assert.NoError(t, err)
+		if tt.expectError == "" {
 			for i := 'a'; i <= 'e'; i++ {
-				f, err := os.Create(tt.imageDir + "/" + string(i) + ".png")
+				_, err := tt.store.Put(context.Background(), string(i)+".png", strings.NewReader(string(i)))
 				assert.NoError(t, err)
-				f.Close()
 			}
 		}
 
-		f, err := initFrames(tt.imageDir)
+		f, err := initFrames(context.Background(), tt.store, nil)
 		if tt.expectError != "" {
 			assert.EqualError(t, err, tt.expectError)
 		} else {
-			e := os.RemoveAll(tt.imageDir)
-			assert.NoError(t, e)
 			assert.NoError(t, err)
 
 			for index, frame := range f {
@@ -281,7 +290,7 @@ func TestMatchSubtitlesExact(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		f, err := matchSubtitlesExact(frames, tt.input, tt.numFrames)
+		f, err := matchSubtitlesExact(nil, frames, tt.input, tt.numFrames)
 		if tt.expectError != "" {
 			assert.EqualError(t, err, tt.expectError)
 		} else {
@@ -314,7 +323,7 @@ func TestGetRandomFrames(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		f, err := getRandomFrames(frames, tt.numFrames)
+		f, err := getRandomFrames(nil, frames, tt.numFrames)
 		if tt.expectError != "" {
 			assert.EqualError(t, err, tt.expectError)
 		} else {
@@ -322,6 +331,96 @@ func TestGetRandomFrames(t *testing.T) {
 			assert.Equal(t, tt.numFrames, len(f))
 		}
 	}
+
+	first, err := getRandomFrames(rand.New(rand.NewSource(42)), frames, 3)
+	assert.NoError(t, err)
+	second, err := getRandomFrames(rand.New(rand.NewSource(42)), frames, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, first, second)
+}
+
+func TestSessionsPick(t *testing.T) {
+	var frames []Frame
+	for i := 'a'; i <= 'e'; i++ {
+		frames = append(frames, Frame{Filename: string(i) + ".png", Subtitle: string(i)})
+	}
+	names := func(frames []Frame) []string {
+		var names []string
+		for _, f := range frames {
+			names = append(names, f.Filename)
+		}
+		return names
+	}
+
+	tests := []struct {
+		name   string
+		counts []int
+		// wantCycles is how many times each frame is returned in total.
+		wantCycles int
+	}{
+		{name: "one cycle in single frames", counts: []int{1, 1, 1, 1, 1}, wantCycles: 1},
+		{name: "one cycle in uneven calls", counts: []int{2, 3}, wantCycles: 1},
+		{name: "calls spanning cycles", counts: []int{3, 3, 3, 1}, wantCycles: 2},
+		{name: "whole cycles", counts: []int{5, 5, 5}, wantCycles: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sessions := NewSessions(time.Hour, 10)
+			seen := map[string]int{}
+			for _, count := range tt.counts {
+				picked, err := sessions.Pick("client", "token", nil, frames, nil, count)
+				require.NoError(t, err)
+				require.Len(t, picked, count)
+				distinct := map[string]bool{}
+				for _, name := range names(picked) {
+					distinct[name] = true
+					seen[name]++
+				}
+				assert.Len(t, distinct, count, "a call returned a frame twice")
+			}
+			for _, f := range frames {
+				assert.Equal(t, tt.wantCycles, seen[f.Filename], f.Filename)
+			}
+		})
+	}
+
+	t.Run("invalid count", func(t *testing.T) {
+		_, err := NewSessions(time.Hour, 10).Pick("client", "token", nil, frames, nil, 6)
+		assert.EqualError(t, err, "invalid number of frames: 6")
+	})
+
+	t.Run("separate sessions", func(t *testing.T) {
+		sessions := NewSessions(time.Hour, 10)
+		for _, key := range [][2]string{{"client", "a"}, {"client", "b"}, {"other", "a"}} {
+			picked, err := sessions.Pick(key[0], key[1], nil, frames, nil, 5)
+			require.NoError(t, err)
+			assert.Len(t, picked, 5, key)
+		}
+		assert.Len(t, sessions.sessions, 3)
+	})
+
+	t.Run("expiry and eviction", func(t *testing.T) {
+		now := time.Unix(0, 0)
+		sessions := NewSessions(time.Minute, 2)
+		sessions.now = func() time.Time { return now }
+
+		_, err := sessions.Pick("client", "a", nil, frames, nil, 4)
+		require.NoError(t, err)
+		now = now.Add(2 * time.Minute)
+		// The expired session starts over, so any frame may come back.
+		picked, err := sessions.Pick("client", "a", nil, frames, nil, 5)
+		require.NoError(t, err)
+		assert.Len(t, picked, 5)
+
+		now = now.Add(time.Second)
+		_, err = sessions.Pick("client", "b", nil, frames, nil, 1)
+		require.NoError(t, err)
+		now = now.Add(time.Second)
+		_, err = sessions.Pick("client", "c", nil, frames, nil, 1)
+		require.NoError(t, err)
+		assert.Len(t, sessions.sessions, 2)
+		assert.NotContains(t, sessions.sessions, "client\x00a")
+	})
 }
 
 func FuzzGetRandomFrames(f *testing.F) {
@@ -330,7 +429,7 @@ func FuzzGetRandomFrames(f *testing.F) {
 		frames = append(frames, Frame{Filename: string(i) + ".png", Subtitle: string(i)})
 	}
 	f.Fuzz(func(t *testing.T, numFrames int) {
-		frames, err := getRandomFrames(frames, numFrames)
+		frames, err := getRandomFrames(nil, frames, numFrames)
 		if numFrames < 0 || numFrames > len(frames) {
 			assert.EqualError(t, err, "invalid number of frames: "+fmt.Sprint(numFrames))
 		} else {
@@ -339,3 +438,661 @@ func FuzzGetRandomFrames(f *testing.F) {
 		}
 	})
 }
+
+func TestGetWeightedFrames(t *testing.T) {
+	frames := []Frame{{Filename: "a.png"}, {Filename: "b.png"}, {Filename: "c.png"}, {Filename: "d.png"}}
+	tests := []struct {
+		name        string
+		weights     []float64
+		numFrames   int
+		wantLast    []string
+		expectError string
+	}{
+		{name: "uniform", weights: []float64{1, 1, 1, 1}, numFrames: 4},
+		{name: "unweighted last", weights: []float64{0, 1, 0, 2}, numFrames: 4, wantLast: []string{"a.png", "c.png"}},
+		{name: "none", weights: []float64{1, 1, 1, 1}, numFrames: 0},
+		{name: "too many", weights: []float64{1, 1, 1, 1}, numFrames: 5, expectError: "invalid number of frames: 5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			picked, err := getWeightedFrames(nil, frames, tt.weights, tt.numFrames)
+			if tt.expectError != "" {
+				assert.EqualError(t, err, tt.expectError)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, picked, tt.numFrames)
+			if tt.wantLast != nil {
+				var last []string
+				for _, f := range picked[len(picked)-len(tt.wantLast):] {
+					last = append(last, f.Filename)
+				}
+				assert.ElementsMatch(t, tt.wantLast, last)
+			}
+		})
+	}
+
+	// A frame weighing 9 times as much as the other three together is picked
+	// first about 90% of the time.
+	rng := rand.New(rand.NewSource(1))
+	first := 0
+	for i := 0; i < 1000; i++ {
+		picked, err := getWeightedFrames(rng, frames, []float64{1, 1, 27, 1}, 1)
+		require.NoError(t, err)
+		if picked[0].Filename == "c.png" {
+			first++
+		}
+	}
+	assert.InDelta(t, 900, first, 50)
+}
+
+func TestStrategies(t *testing.T) {
+	cat, err := catalog.Open(filepath.Join(t.TempDir(), "catalog.db"))
+	require.NoError(t, err)
+	defer cat.Close()
+	require.NoError(t, cat.Put(catalog.Frame{Name: "a.png", Hash: "a"}, catalog.Frame{Name: "b.png", Hash: "b"}))
+	_, err = cat.Increment("b.png", counterDownloads, 3)
+	require.NoError(t, err)
+
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	frames := []Frame{
+		{Filename: "a.png", AddedAt: now, Tags: []string{"series:frieren"}},
+		{Filename: "b.png", AddedAt: now.Add(-60 * 24 * time.Hour), Tags: []string{"cat"}},
+		{Filename: "c.png"},
+	}
+	strategies := DefaultStrategies(NewUsage(cat))
+	strategies["recent"] = Recent{HalfLife: 30 * 24 * time.Hour, now: func() time.Time { return now }}
+
+	tests := []struct {
+		query       string
+		want        []float64
+		expectError string
+	}{
+		{query: "", want: nil},
+		{query: "strategy=popular", want: []float64{1, 4, 1}},
+		{query: "strategy=recent", want: []float64{1, 0.25, 0}},
+		{query: "strategy=tags&tag=series:frieren", want: []float64{10, 1, 1}},
+		{query: "strategy=tags&tag=series:frieren&tag=cat", want: []float64{10, 10, 1}},
+		{query: "strategy=tags", expectError: "invalid strategy: tags needs at least one tag parameter"},
+		{query: "strategy=oldest", expectError: `invalid strategy: unknown strategy "oldest"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/frame/random/1?"+tt.query, nil)
+			weights, err := strategies.weights(req, frames)
+			if tt.expectError != "" {
+				assert.EqualError(t, err, tt.expectError)
+				assert.ErrorIs(t, err, ErrInvalidStrategy)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, weights)
+		})
+	}
+}
+
+func TestIndexFrames(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemory()
+	for _, name := range []string{"a.png", "b.png", ".hidden.png"} {
+		_, err := store.Put(ctx, name, strings.NewReader(name))
+		assert.NoError(t, err)
+	}
+
+	index := NewIndex(store, nil)
+	assert.False(t, index.Status().Loaded)
+
+	frames, err := index.Frames(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(frames))
+	status := index.Status()
+	assert.True(t, status.Loaded)
+	assert.Equal(t, 2, status.Frames)
+
+	// Hidden files are left alone.
+	_, err = store.Stat(ctx, ".hidden.png")
+	assert.NoError(t, err)
+
+	// Adding a frame changes the version, so the next call scans again.
+	_, err = store.Put(ctx, "c.png", strings.NewReader("c"))
+	assert.NoError(t, err)
+	frames, err = index.Frames(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(frames))
+
+	index = NewIndex(storage.NewLocal(filepath.Join(t.TempDir(), "nonexistent")), nil)
+	_, err = index.Frames(ctx)
+	assert.Error(t, err)
+	assert.False(t, index.Status().Loaded)
+}
+
+// presigningStore presigns URLs on example.com.
+type presigningStore struct {
+	storage.Backend
+}
+
+func (presigningStore) PresignGet(ctx context.Context, name string) (string, error) {
+	return "https://example.com/" + name + "?signature=x", nil
+}
+
+func TestHandleDownload(t *testing.T) {
+	store := storage.NewMemory()
+	_, err := store.Put(context.Background(), "a.png", strings.NewReader("frame"))
+	assert.NoError(t, err)
+	hash := strings.Repeat("ab", 32)
+	hashed := "b_" + hash + ".png"
+	_, err = store.Put(context.Background(), hashed, strings.NewReader("hashed frame"))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		store        storage.Backend
+		image        string
+		ifNoneMatch  string
+		wantStatus   int
+		wantBody     string
+		wantLocation string
+		wantETag     string
+		wantCache    string
+	}{
+		{name: "exists", store: store, image: "a.png", wantStatus: http.StatusOK, wantBody: "frame"},
+		{name: "missing", store: store, image: "b.png", wantStatus: http.StatusNotFound},
+		{name: "invalid name", store: store, image: "..%2Fa.png", wantStatus: http.StatusNotFound},
+		{name: "presigned", store: presigningStore{store}, image: "a.png", wantStatus: http.StatusTemporaryRedirect, wantLocation: "https://example.com/a.png?signature=x"},
+		{name: "presigned missing", store: presigningStore{store}, image: "b.png", wantStatus: http.StatusNotFound},
+		{name: "hashed", store: store, image: hashed, wantStatus: http.StatusOK, wantBody: "hashed frame", wantETag: `"` + hash + `"`, wantCache: immutable},
+		{name: "hashed not modified", store: store, image: hashed, ifNoneMatch: `"` + hash + `"`, wantStatus: http.StatusNotModified, wantETag: `"` + hash + `"`, wantCache: immutable},
+		{name: "hashed weak match", store: store, image: hashed, ifNoneMatch: `"other", W/"` + hash + `"`, wantStatus: http.StatusNotModified, wantETag: `"` + hash + `"`, wantCache: immutable},
+		{name: "hashed modified", store: store, image: hashed, ifNoneMatch: `"other"`, wantStatus: http.StatusOK, wantBody: "hashed frame", wantETag: `"` + hash + `"`, wantCache: immutable},
+		{name: "hashed presigned", store: presigningStore{store}, image: hashed, wantStatus: http.StatusTemporaryRedirect, wantLocation: "https://example.com/" + hashed + "?signature=x"},
+		{name: "hashed presigned not modified", store: presigningStore{store}, image: hashed, ifNoneMatch: `"` + hash + `"`, wantStatus: http.StatusNotModified, wantETag: `"` + hash + `"`, wantCache: immutable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/frame/x", nil)
+			req.SetPathValue("image", tt.image)
+			if tt.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			w := httptest.NewRecorder()
+
+			usage := NewUsage(nil)
+			HandleDownload(tt.store, usage).ServeHTTP(w, req)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantBody != "" || tt.wantStatus == http.StatusNotModified {
+				assert.Equal(t, tt.wantBody, w.Body.String())
+			}
+			assert.Equal(t, tt.wantLocation, w.Header().Get("Location"))
+			assert.Equal(t, tt.wantETag, w.Header().Get("ETag"))
+			assert.Equal(t, tt.wantCache, w.Header().Get("Cache-Control"))
+
+			// Only frames sent or redirected to count as downloads.
+			downloads, err := usage.counts(counterDownloads)
+			require.NoError(t, err)
+			var want uint64
+			if tt.wantStatus == http.StatusOK || tt.wantStatus == http.StatusTemporaryRedirect {
+				want = 1
+			}
+			assert.Equal(t, want, downloads[tt.image])
+		})
+	}
+}
+
+func TestHandleByHash(t *testing.T) {
+	ctx := context.Background()
+	hashA := "aaaaaaaa" + strings.Repeat("1", 56)
+	hashB := "aaaaaaaa" + strings.Repeat("2", 56)
+	hashC := strings.Repeat("c", 64)
+	store := storage.NewMemory()
+	// d has the same content as a.
+	for name, content := range map[string]string{"a_" + hashA + ".png": "a", "d_" + hashA + ".png": "a", "b_" + hashB + ".png": "b", "c_" + hashC + ".jpg": "c"} {
+		_, err := store.Put(ctx, name, strings.NewReader(content))
+		assert.NoError(t, err)
+	}
+	index := NewIndex(store, nil)
+
+	tests := []struct {
+		name       string
+		hash       string
+		wantStatus int
+		wantBody   string
+		wantCache  string
+	}{
+		{name: "full hash", hash: hashC, wantStatus: http.StatusOK, wantBody: "c", wantCache: immutable},
+		{name: "prefix", hash: hashC[:8], wantStatus: http.StatusOK, wantBody: "c", wantCache: "no-cache"},
+		{name: "upper case", hash: strings.ToUpper(hashC[:10]), wantStatus: http.StatusOK, wantBody: "c", wantCache: "no-cache"},
+		{name: "same content", hash: hashA[:9], wantStatus: http.StatusOK, wantBody: "a", wantCache: "no-cache"},
+		{name: "ambiguous", hash: hashA[:8], wantStatus: http.StatusConflict, wantBody: ErrAmbiguousHash.Error() + "\n"},
+		{name: "unknown", hash: strings.Repeat("d", 8), wantStatus: http.StatusNotFound, wantBody: "404 page not found\n"},
+		{name: "too short", hash: hashC[:7], wantStatus: http.StatusBadRequest, wantBody: "Hash must be 8 to 64 hex digits\n"},
+		{name: "too long", hash: hashC + "c", wantStatus: http.StatusBadRequest, wantBody: "Hash must be 8 to 64 hex digits\n"},
+		{name: "not hex", hash: "cccccccx", wantStatus: http.StatusBadRequest, wantBody: "Hash must be 8 to 64 hex digits\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/frame/by-hash/x", nil)
+			req.SetPathValue("hash", tt.hash)
+			w := httptest.NewRecorder()
+
+			HandleByHash(index, store, NewUsage(nil)).ServeHTTP(w, req)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantBody, w.Body.String())
+			assert.Equal(t, tt.wantCache, w.Header().Get("Cache-Control"))
+		})
+	}
+}
+
+func TestWriteBundle(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemory()
+	for name, content := range map[string]string{"a_1.png": "aaaaa", "字幕_2.jpg": "bbbbb", "c_3.png": strings.Repeat("c", 20)} {
+		_, err := store.Put(ctx, name, strings.NewReader(content))
+		assert.NoError(t, err)
+	}
+	frames := []Frame{
+		{Filename: "a_1.png", Subtitle: "a", Size: 5},
+		{Filename: "missing_4.png", Subtitle: "missing", Size: 1},
+		{Filename: "c_3.png", Subtitle: "c", Size: 20},
+		{Filename: "字幕_2.jpg", Subtitle: "字幕", Size: 5},
+	}
+
+	w := httptest.NewRecorder()
+	writeBundle(w, httptest.NewRequest(http.MethodGet, "/frame/random/4?include=images", nil), store, frames, 12)
+	assert.Equal(t, http.StatusOK, w.Code)
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/mixed", mediaType)
+
+	type part struct{ contentType, fileName, body string }
+	var parts []part
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		body, err := io.ReadAll(p)
+		require.NoError(t, err)
+		parts = append(parts, part{p.Header.Get("Content-Type"), p.FileName(), string(body)})
+	}
+	// c does not fit and missing is left out.
+	require.Len(t, parts, 3)
+	assert.Equal(t, "application/json", parts[0].contentType)
+	var got []Frame
+	require.NoError(t, json.Unmarshal([]byte(parts[0].body), &got))
+	assert.Equal(t, frames, got)
+	assert.Equal(t, part{"image/png", "a_1.png", "aaaaa"}, parts[1])
+	assert.Equal(t, part{"image/jpeg", "字幕_2.jpg", "bbbbb"}, parts[2])
+}
+
+func TestHandleSearchInclude(t *testing.T) {
+	store := storage.NewMemory()
+	_, err := store.Put(context.Background(), "a_"+strings.Repeat("1", 64)+".png", strings.NewReader("a"))
+	assert.NoError(t, err)
+	index := NewIndex(store, nil)
+
+	tests := []struct {
+		target          string
+		wantStatus      int
+		wantContentType string
+	}{
+		{target: "/frame/random/1", wantStatus: http.StatusOK, wantContentType: "text/plain; charset=utf-8"},
+		{target: "/frame/random/1?include=images", wantStatus: http.StatusOK, wantContentType: "multipart/mixed"},
+		{target: "/frame/random/1?include=thumbnails", wantStatus: http.StatusBadRequest, wantContentType: "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		req.SetPathValue("count", "1")
+		w := httptest.NewRecorder()
+		HandleRandom(index, NewUsage(nil), NewSessions(time.Hour, 10), nil, 10, 1<<20).ServeHTTP(w, req)
+		assert.Equal(t, tt.wantStatus, w.Code, tt.target)
+		assert.Contains(t, w.Header().Get("Content-Type"), tt.wantContentType, tt.target)
+	}
+}
+
+func TestHandleRandomSeed(t *testing.T) {
+	store := storage.NewMemory()
+	for i := 'a'; i <= 'z'; i++ {
+		_, err := store.Put(context.Background(), string(i)+"_"+strings.Repeat("1", 64)+".png", strings.NewReader("a"))
+		require.NoError(t, err)
+	}
+	handler := HandleRandom(NewIndex(store, nil), NewUsage(nil), NewSessions(time.Hour, 10), nil, 10, 1<<20)
+	get := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.SetPathValue("count", "5")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	first := get("/frame/random/5?seed=42")
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, first.Body.String(), get("/frame/random/5?seed=42").Body.String())
+	assert.NotEqual(t, first.Body.String(), get("/frame/random/5?seed=43").Body.String())
+
+	for _, target := range []string{"/frame/random/5?seed=", "/frame/random/5?seed=abc", "/frame/random/5?session=" + strings.Repeat("x", 65), "/frame/random/5?strategy=popular"} {
+		w := get(target)
+		assert.Equal(t, http.StatusBadRequest, w.Code, target)
+	}
+	assert.Equal(t, "seed must be an integer\n", get("/frame/random/5?seed=1.5").Body.String())
+}
+
+func TestDailyPick(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemory()
+	var names []string
+	for i := 0; i < 6; i++ {
+		name := strconv.Itoa(i) + "_" + strings.Repeat(strconv.Itoa(i), 64) + ".png"
+		names = append(names, name)
+		_, err := store.Put(ctx, name, strings.NewReader(name))
+		require.NoError(t, err)
+	}
+	cat, err := catalog.Open(filepath.Join(t.TempDir(), "catalog.db"))
+	require.NoError(t, err)
+	defer cat.Close()
+	index := NewIndex(store, cat)
+	_, err = index.Frames(ctx)
+	require.NoError(t, err)
+	for _, name := range names[:2] {
+		entry, err := cat.Get(name)
+		require.NoError(t, err)
+		entry.Tags = []string{"series:frieren"}
+		require.NoError(t, cat.Put(entry))
+	}
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	newDaily := func(index *Index) *Daily {
+		daily := NewDaily(index, 4)
+		daily.now = func() time.Time { return now }
+		return daily
+	}
+
+	t.Run("stable within a day", func(t *testing.T) {
+		first, ok, err := newDaily(index).Pick(ctx, "", "1")
+		require.NoError(t, err)
+		require.True(t, ok)
+		// A restarted server picks the same frame.
+		again, _, err := newDaily(NewIndex(store, cat)).Pick(ctx, "", "1")
+		require.NoError(t, err)
+		assert.Equal(t, first.Filename, again.Filename)
+	})
+
+	t.Run("no repeats within the excluded days", func(t *testing.T) {
+		daily := newDaily(index)
+		var picks []string
+		for day := 0; day < 5; day++ {
+			daily.now = func() time.Time { return now.AddDate(0, 0, day) }
+			picked, ok, err := daily.Pick(ctx, "", "2")
+			require.NoError(t, err)
+			require.True(t, ok)
+			assert.NotContains(t, picks, picked.Filename, "day %d", day)
+			picks = append(picks, picked.Filename)
+		}
+	})
+
+	t.Run("series", func(t *testing.T) {
+		daily := newDaily(index)
+		seen := map[string]bool{}
+		for day := 0; day < 4; day++ {
+			daily.now = func() time.Time { return now.AddDate(0, 0, day) }
+			picked, ok, err := daily.Pick(ctx, "frieren", "")
+			require.NoError(t, err)
+			require.True(t, ok)
+			assert.Contains(t, names[:2], picked.Filename)
+			seen[picked.Filename] = true
+		}
+		// With fewer frames than excluded days, picks repeat once all were picked.
+		assert.Len(t, seen, 2)
+
+		_, ok, err := daily.Pick(ctx, "unknown", "")
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("deleted pick", func(t *testing.T) {
+		store := storage.NewMemory()
+		for _, name := range names {
+			_, err := store.Put(ctx, name, strings.NewReader(name))
+			require.NoError(t, err)
+		}
+		index := NewIndex(store, cat)
+		first, _, err := newDaily(index).Pick(ctx, "", "3")
+		require.NoError(t, err)
+		require.NoError(t, store.Delete(ctx, first.Filename))
+		require.NoError(t, cat.Delete(first.Filename))
+		second, ok, err := newDaily(index).Pick(ctx, "", "3")
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.NotEqual(t, first.Filename, second.Filename)
+	})
+
+	t.Run("without catalog", func(t *testing.T) {
+		first, ok, err := newDaily(NewIndex(store, nil)).Pick(ctx, "", "4")
+		require.NoError(t, err)
+		require.True(t, ok)
+		again, _, err := newDaily(NewIndex(store, nil)).Pick(ctx, "", "4")
+		require.NoError(t, err)
+		assert.Equal(t, first.Filename, again.Filename)
+
+		// The plain picks of the excluded days are not picked again.
+		daily := newDaily(NewIndex(store, nil))
+		frames, err := daily.index.Frames(ctx)
+		require.NoError(t, err)
+		scope := url.Values{"series": {""}, "chat": {"4"}}.Encode()
+		for day := 0; day < 10; day++ {
+			date := now.AddDate(0, 0, day)
+			daily.now = func() time.Time { return date }
+			picked, ok, err := daily.Pick(ctx, "", "4")
+			require.NoError(t, err)
+			require.True(t, ok)
+			for i := 1; i <= daily.excludeDays; i++ {
+				recent := pickDaily(frames, scope, date.AddDate(0, 0, -i).Format(time.DateOnly))
+				assert.NotEqual(t, recent.Filename, picked.Filename, "day %d", day)
+			}
+		}
+	})
+}
+
+func TestHandleDaily(t *testing.T) {
+	store := storage.NewMemory()
+	_, err := store.Put(context.Background(), "a_"+strings.Repeat("1", 64)+".png", strings.NewReader("a"))
+	require.NoError(t, err)
+	handler := HandleDaily(NewDaily(NewIndex(store, nil), 0), NewUsage(nil), 1<<20)
+
+	tests := []struct {
+		target     string
+		wantStatus int
+		wantBody   string
+	}{
+		{target: "/frame/daily", wantStatus: http.StatusOK, wantBody: `[{"name":"a_`},
+		{target: "/frame/daily?chat=-100123&series=frieren", wantStatus: http.StatusNotFound, wantBody: "No frame to pick"},
+		{target: "/frame/daily?chat=general", wantStatus: http.StatusBadRequest, wantBody: "chat must be an integer"},
+		{target: "/frame/daily?include=thumbnails", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		assert.Equal(t, tt.wantStatus, w.Code, tt.target)
+		assert.Contains(t, w.Body.String(), tt.wantBody, tt.target)
+	}
+
+	// Recent picks are excluded without a catalog as well.
+	w := httptest.NewRecorder()
+	HandleDaily(NewDaily(NewIndex(store, nil), 30), NewUsage(nil), 1<<20).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/frame/daily", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `[{"name":"a_`)
+}
+
+func TestUsage(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemory()
+	var names []string
+	for i, subtitle := range []string{"a", "b", "c"} {
+		name := subtitle + "_" + strings.Repeat(strconv.Itoa(i), 64) + ".png"
+		names = append(names, name)
+		_, err := store.Put(ctx, name, strings.NewReader(subtitle))
+		require.NoError(t, err)
+	}
+	frame := func(name string) Frame { return Frame{Filename: name} }
+
+	record := func(usage *Usage) {
+		usage.Searched("Hello  World", []Frame{frame(names[0]), frame(names[1])})
+		usage.Searched("hello world", []Frame{frame(names[1])})
+		usage.Searched("bye", nil)
+		usage.Searched("", []Frame{frame(names[1])})
+		usage.Searched(strings.Repeat("x", maxQueryLength+1), nil)
+		usage.Downloaded(names[2])
+		usage.Downloaded(names[2])
+		usage.Downloaded(names[0])
+		usage.Downloaded("deleted_" + strings.Repeat("9", 64) + ".png")
+	}
+	check := func(t *testing.T, usage *Usage, index *Index) {
+		top, err := usage.TopFrames(ctx, index, counterSearches, 10)
+		require.NoError(t, err)
+		assert.Equal(t, []FrameUsage{
+			{Name: names[1], Subtitle: "b", Searches: 3},
+			{Name: names[0], Subtitle: "a", Searches: 1, Downloads: 1},
+		}, top)
+		top, err = usage.TopFrames(ctx, index, counterDownloads, 1)
+		require.NoError(t, err)
+		assert.Equal(t, []FrameUsage{{Name: names[2], Subtitle: "c", Downloads: 2}}, top)
+
+		queries, err := usage.TopQueries(10)
+		require.NoError(t, err)
+		assert.Equal(t, []QueryUsage{{Query: "hello world", Count: 2}, {Query: "bye", Count: 1}}, queries)
+	}
+
+	t.Run("without catalog", func(t *testing.T) {
+		usage := NewUsage(nil)
+		record(usage)
+		require.NoError(t, usage.Flush())
+		check(t, usage, NewIndex(store, nil))
+	})
+
+	t.Run("with catalog", func(t *testing.T) {
+		cat, err := catalog.Open(filepath.Join(t.TempDir(), "catalog.db"))
+		require.NoError(t, err)
+		defer cat.Close()
+		index := NewIndex(store, cat)
+		_, err = index.Frames(ctx)
+		require.NoError(t, err)
+
+		usage := NewUsage(cat)
+		record(usage)
+		// Counts not flushed yet are included.
+		check(t, usage, index)
+		require.NoError(t, usage.Flush())
+		check(t, usage, index)
+		// A restarted server reads the counts from the catalog.
+		check(t, NewUsage(cat), index)
+		counters, err := cat.Counters(names[2])
+		require.NoError(t, err)
+		assert.Equal(t, map[string]uint64{counterDownloads: 2}, counters)
+
+		// Values read from the catalog are cached until the next flush.
+		require.NoError(t, cat.AddCounters(map[string]map[string]uint64{names[2]: {counterDownloads: 1}}))
+		downloads, err := usage.counts(counterDownloads)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(2), downloads[names[2]])
+		require.NoError(t, usage.Flush())
+		downloads, err = usage.counts(counterDownloads)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(3), downloads[names[2]])
+	})
+}
+
+func TestHandleStats(t *testing.T) {
+	store := storage.NewMemory()
+	name := "a_" + strings.Repeat("1", 64) + ".png"
+	_, err := store.Put(context.Background(), name, strings.NewReader("a"))
+	require.NoError(t, err)
+	index := NewIndex(store, nil)
+	usage := NewUsage(nil)
+	usage.Searched("hello", []Frame{{Filename: name}})
+	usage.Downloaded(name)
+
+	tests := []struct {
+		handler    http.Handler
+		target     string
+		wantStatus int
+		wantBody   string
+	}{
+		{handler: HandleTopFrames(index, usage), target: "/stats/top-frames", wantStatus: http.StatusOK, wantBody: `[{"name":"` + name + `","subtitle":"a","searches":1,"downloads":1}]`},
+		{handler: HandleTopFrames(index, usage), target: "/stats/top-frames?by=downloads&limit=100", wantStatus: http.StatusOK, wantBody: `"downloads":1}]`},
+		{handler: HandleTopFrames(index, NewUsage(nil)), target: "/stats/top-frames", wantStatus: http.StatusOK, wantBody: `[]`},
+		{handler: HandleTopFrames(index, usage), target: "/stats/top-frames?by=uploads", wantStatus: http.StatusBadRequest, wantBody: "by must be searches or downloads"},
+		{handler: HandleTopFrames(index, usage), target: "/stats/top-frames?limit=0", wantStatus: http.StatusBadRequest, wantBody: "limit must be 1 to 100"},
+		{handler: HandleTopQueries(usage), target: "/stats/top-queries?limit=1", wantStatus: http.StatusOK, wantBody: `[{"query":"hello","count":1}]`},
+		{handler: HandleTopQueries(usage), target: "/stats/top-queries?limit=101", wantStatus: http.StatusBadRequest, wantBody: "limit must be 1 to 100"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		assert.Equal(t, tt.wantStatus, w.Code, tt.target)
+		assert.Contains(t, w.Body.String(), tt.wantBody, tt.target)
+	}
+}
+
+func TestWriteFrames(t *testing.T) {
+	frames := []Frame{{Filename: "a_1.png", Subtitle: "a", Size: 1}}
+	w := httptest.NewRecorder()
+	writeFrames(w, httptest.NewRequest(http.MethodGet, "/frame/random/1", nil), frames)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[{"name":"a_1.png","subtitle":"a","size":1}]`, w.Body.String())
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+	etag := w.Header().Get("ETag")
+	assert.Regexp(t, `^"[0-9a-f]{32}"$`, etag)
+
+	req := httptest.NewRequest(http.MethodGet, "/frame/random/1", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	writeFrames(w, req, frames)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+
+	// Other frames have another ETag.
+	w = httptest.NewRecorder()
+	writeFrames(w, req, []Frame{})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "[]", w.Body.String())
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+}
+
+func TestIndexCatalog(t *testing.T) {
+	ctx := context.Background()
+	cat, err := catalog.Open(filepath.Join(t.TempDir(), "catalog.db"))
+	assert.NoError(t, err)
+	defer cat.Close()
+
+	store := storage.NewMemory()
+	for _, name := range []string{"a.png", "b.png"} {
+		_, err := store.Put(ctx, name, strings.NewReader(name))
+		assert.NoError(t, err)
+	}
+	index := NewIndex(store, cat)
+	frames, err := index.Frames(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(frames))
+
+	// Frames found by the scan are added with the subtitle from their name.
+	entries, err := cat.List()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(entries))
+	entry := entries[0]
+	assert.Equal(t, "a", entry.Subtitle)
+	assert.Equal(t, "a_"+entry.Hash+".png", entry.Name)
+	assert.Equal(t, int64(5), entry.Size)
+
+	// Subtitles in the catalog win over file names, and changing them
+	// invalidates the index.
+	_, err = index.Frames(ctx)
+	assert.NoError(t, err)
+	entry.Subtitle = "apple"
+	assert.NoError(t, cat.Put(entry))
+	frames, err = index.Frames(ctx)
+	assert.NoError(t, err)
+	assert.Contains(t, frames, Frame{Filename: entry.Name, Subtitle: "apple", Size: 5, AddedAt: entry.AddedAt})
+}
@@ -1,17 +1,197 @@
 package frame
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math/rand"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"path/filepath"
 	"strconv"
+	"strings"
+
+	"AnimeFrameBot/internal/metrics"
+	"AnimeFrameBot/internal/storage"
+)
+
+var searchResults = metrics.NewHistogram(
+	"frame_search_results",
+	"Number of frames returned per search.",
+	[]float64{0, 1, 2, 3, 5, 10, 20, 50},
+	"mode",
 )
 
-func HandleRandom(imageDir string) http.HandlerFunc {
+// immutable is the Cache-Control of frames with hashed names, whose content
+// never changes.
+const immutable = "public, max-age=31536000, immutable"
+
+func setCaching(w http.ResponseWriter, etag, cacheControl string) {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+}
+
+// matchesETag reports whether the If-None-Match header of r lists etag.
+// If-None-Match compares weakly, so a "W/" prefix is ignored.
+func matchesETag(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFrames writes frames as JSON with an ETag derived from the response, or
+// 304 Not Modified if the client already has it. Clients and caches must
+// revalidate, as the same search can return other frames later.
+func writeFrames(w http.ResponseWriter, r *http.Request, frames []Frame) {
+	bytes, err := json.Marshal(frames)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	sum := sha256.Sum256(bytes)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if matchesETag(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	_, _ = w.Write(bytes)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(bytes)
+}
+
+// includesImages reports whether a search asks for the images of the frames
+// in the response with ?include=images.
+func includesImages(r *http.Request) (bool, error) {
+	switch r.URL.Query().Get("include") {
+	case "":
+		return false, nil
+	case "images":
+		return true, nil
+	}
+	return false, errors.New("include must be images")
+}
+
+// writeBundle writes frames as a multipart/mixed response: their JSON, then
+// the image of each frame in the same order, named by its file name. Images are
+// added while their total size stays within maxBytes; the others are left out
+// and can be downloaded on their own.
+func writeBundle(w http.ResponseWriter, r *http.Request, store storage.Backend, frames []Frame, maxBytes int64) {
+	bytes, err := json.Marshal(frames)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.Header().Set("Cache-Control", "no-cache")
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json"}})
+	if err != nil {
+		return
+	}
+	if _, err := part.Write(bytes); err != nil {
+		return
+	}
+
+	var total int64
+	for _, f := range frames {
+		if total+f.Size > maxBytes {
+			continue
+		}
+		if err := writeBundlePart(r.Context(), mw, store, f.Filename); err != nil {
+			slog.ErrorContext(r.Context(), "bundle frame", "file", f.Filename, "error", err)
+			if errors.Is(err, errBundleWrite) {
+				return
+			}
+			continue
+		}
+		total += f.Size
+	}
+	_ = mw.Close()
+}
+
+// errBundleWrite marks failures after the part of an image was started. The
+// response cannot go on after them.
+var errBundleWrite = errors.New("write bundle")
+
+func writeBundlePart(ctx context.Context, mw *multipart.Writer, store storage.Backend, fileName string) error {
+	file, err := store.Open(ctx, fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	contentType := mime.TypeByExtension(filepath.Ext(fileName))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {contentType},
+		"Content-Disposition": {mime.FormatMediaType("attachment", map[string]string{"filename": fileName})},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", errBundleWrite, err)
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return fmt.Errorf("%w: %v", errBundleWrite, err)
+	}
+	return nil
+}
+
+// randomSource returns a random source seeded with the seed query parameter,
+// or nil to use the global one when there is none.
+func randomSource(r *http.Request) (*rand.Rand, error) {
+	if !r.URL.Query().Has("seed") {
+		return nil, nil
+	}
+	seed, err := strconv.ParseInt(r.URL.Query().Get("seed"), 10, 64)
+	if err != nil {
+		return nil, errors.New("seed must be an integer")
+	}
+	return rand.New(rand.NewSource(seed)), nil
+}
+
+// sessionToken returns the session query parameter, or "" when there is none.
+func sessionToken(r *http.Request) (string, error) {
+	token := r.URL.Query().Get("session")
+	if len(token) > maxSessionToken {
+		return "", fmt.Errorf("session must be at most %d characters", maxSessionToken)
+	}
+	return token, nil
+}
+
+func HandleRandom(index *Index, usage *Usage, sessions *Sessions, strategies Strategies, maxCount int, maxBundleBytes int64) http.HandlerFunc {
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
-			frames, err := initFrames(imageDir)
+			frames, err := index.Frames(r.Context())
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				return
@@ -23,27 +203,62 @@ func HandleRandom(imageDir string) http.HandlerFunc {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
+			if imageCount > maxCount {
+				http.Error(w, "Count exceeds the maximum of "+strconv.Itoa(maxCount), http.StatusBadRequest)
+				return
+			}
+			bundle, err := includesImages(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 
-			randomFrames, err := getRandomFrames(frames, imageCount)
+			rng, err := randomSource(r)
 			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			token, err := sessionToken(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 
-			bytes, err := json.Marshal(randomFrames)
+			weights, err := strategies.weights(r, frames)
+			if errors.Is(err, ErrInvalidStrategy) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
+				slog.ErrorContext(r.Context(), "weight frames", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
 
-			_, _ = w.Write(bytes)
+			var randomFrames []Frame
+			if token != "" {
+				randomFrames, err = sessions.Pick(clientFromContext(r.Context()), token, rng, frames, weights, imageCount)
+			} else {
+				randomFrames, err = pickFrames(rng, frames, weights, imageCount)
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			searchResults.Observe(float64(len(randomFrames)), "random")
+			usage.Searched("", randomFrames)
+			if bundle {
+				writeBundle(w, r, index.store, randomFrames, maxBundleBytes)
+				return
+			}
+			writeFrames(w, r, randomFrames)
 		})
 }
 
-func HandleFuzzy(imageDir string) http.HandlerFunc {
+func HandleFuzzy(index *Index, usage *Usage, maxCount int, maxBundleBytes int64) http.HandlerFunc {
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
-			frames, err := initFrames(imageDir)
+			frames, err := index.Frames(r.Context())
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				return
@@ -62,26 +277,35 @@ func HandleFuzzy(imageDir string) http.HandlerFunc {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
-
-			randomFrames, err := matchSubtitles(frames, queryStr, imageCount)
+			if imageCount > maxCount {
+				http.Error(w, "Count exceeds the maximum of "+strconv.Itoa(maxCount), http.StatusBadRequest)
+				return
+			}
+			bundle, err := includesImages(r)
 			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 
-			bytes, err := json.Marshal(randomFrames)
+			randomFrames, err := matchSubtitles(frames, queryStr, imageCount)
 			if err != nil {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
-			_, _ = w.Write(bytes)
+			searchResults.Observe(float64(len(randomFrames)), "fuzzy")
+			usage.Searched(queryStr, randomFrames)
+			if bundle {
+				writeBundle(w, r, index.store, randomFrames, maxBundleBytes)
+				return
+			}
+			writeFrames(w, r, randomFrames)
 		})
 }
 
-func HandleExact(imageDir string) http.HandlerFunc {
+func HandleExact(index *Index, usage *Usage, maxCount int, maxBundleBytes int64) http.HandlerFunc {
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
-			frames, err := initFrames(imageDir)
+			frames, err := index.Frames(r.Context())
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				return
@@ -100,23 +324,144 @@ func HandleExact(imageDir string) http.HandlerFunc {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
+			if imageCount > maxCount {
+				http.Error(w, "Count exceeds the maximum of "+strconv.Itoa(maxCount), http.StatusBadRequest)
+				return
+			}
+			bundle, err := includesImages(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 
-			randomFrames, err := matchSubtitlesExact(frames, queryStr, imageCount)
+			rng, err := randomSource(r)
 			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 
-			bytes, err := json.Marshal(randomFrames)
+			randomFrames, err := matchSubtitlesExact(rng, frames, queryStr, imageCount)
 			if err != nil {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
-			_, _ = w.Write(bytes)
+			searchResults.Observe(float64(len(randomFrames)), "exact")
+			usage.Searched(queryStr, randomFrames)
+			if bundle {
+				writeBundle(w, r, index.store, randomFrames, maxBundleBytes)
+				return
+			}
+			writeFrames(w, r, randomFrames)
 		})
 }
 
-func HandleDownload(imageDir string) http.HandlerFunc {
+// HandleDaily returns the frame of the day, as an array of one frame like
+// other searches. The series and chat query parameters scope the pick.
+func HandleDaily(daily *Daily, usage *Usage, maxBundleBytes int64) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			series := r.URL.Query().Get("series")
+			chat := r.URL.Query().Get("chat")
+			if chat != "" {
+				if _, err := strconv.ParseInt(chat, 10, 64); err != nil {
+					http.Error(w, "chat must be an integer", http.StatusBadRequest)
+					return
+				}
+			}
+			bundle, err := includesImages(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			picked, ok, err := daily.Pick(r.Context(), series, chat)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "pick daily frame", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.Error(w, "No frame to pick", http.StatusNotFound)
+				return
+			}
+			searchResults.Observe(1, "daily")
+			frames := []Frame{picked}
+			usage.Searched("", frames)
+			if bundle {
+				writeBundle(w, r, daily.index.store, frames, maxBundleBytes)
+				return
+			}
+			writeFrames(w, r, frames)
+		})
+}
+
+const (
+	defaultStatsLimit = 10
+	maxStatsLimit     = 100
+)
+
+// statsLimit returns the limit query parameter of the stats routes.
+func statsLimit(r *http.Request) (int, error) {
+	if !r.URL.Query().Has("limit") {
+		return defaultStatsLimit, nil
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 || limit > maxStatsLimit {
+		return 0, fmt.Errorf("limit must be 1 to %d", maxStatsLimit)
+	}
+	return limit, nil
+}
+
+// HandleTopFrames returns the frames used most. by is searches, the default,
+// or downloads.
+func HandleTopFrames(index *Index, usage *Usage) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			by := r.URL.Query().Get("by")
+			if by == "" {
+				by = counterSearches
+			}
+			if by != counterSearches && by != counterDownloads {
+				http.Error(w, "by must be searches or downloads", http.StatusBadRequest)
+				return
+			}
+			limit, err := statsLimit(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			top, err := usage.TopFrames(r.Context(), index, by, limit)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "top frames", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, top)
+		})
+}
+
+// HandleTopQueries returns the queries searched most.
+func HandleTopQueries(usage *Usage) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			limit, err := statsLimit(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			top, err := usage.TopQueries(limit)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "top queries", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, top)
+		})
+}
+
+func HandleDownload(store storage.Backend, usage *Usage) http.HandlerFunc {
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			fileNameRaw := r.PathValue("image")
@@ -125,6 +470,110 @@ func HandleDownload(imageDir string) http.HandlerFunc {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
-			http.ServeFile(w, r, filepath.Join(imageDir, fileName))
+			serveFrame(w, r, store, usage, fileName, immutable)
 		})
 }
+
+// minHashPrefix is the shortest hash prefix HandleByHash accepts.
+const minHashPrefix = 8
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// HandleByHash sends the frame with the content hash in the path, which may
+// be shortened to a prefix of at least minHashPrefix hex digits. A prefix
+// matching frames with different content is a conflict.
+func HandleByHash(index *Index, store storage.Backend, usage *Usage) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			prefix := strings.ToLower(r.PathValue("hash"))
+			if len(prefix) < minHashPrefix || len(prefix) > sha256.Size*2 || !isHex(prefix) {
+				http.Error(w, "Hash must be "+strconv.Itoa(minHashPrefix)+" to 64 hex digits", http.StatusBadRequest)
+				return
+			}
+
+			name, err := index.Resolve(r.Context(), prefix)
+			if errors.Is(err, ErrAmbiguousHash) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if name == "" {
+				http.NotFound(w, r)
+				return
+			}
+
+			// A prefix may match another frame once more are added, so only
+			// full hashes are cached for good.
+			cacheControl := "no-cache"
+			if len(prefix) == sha256.Size*2 {
+				cacheControl = immutable
+			}
+			serveFrame(w, r, store, usage, name, cacheControl)
+		})
+}
+
+// serveFrame sends the frame stored under fileName, or redirects to it.
+// Frames with hashed names are identified by their hash, so it is a strong
+// ETag, and they get cacheControl. Redirects to presigned URLs expire and are
+// not cached.
+func serveFrame(w http.ResponseWriter, r *http.Request, store storage.Backend, usage *Usage, fileName, cacheControl string) {
+	info, err := store.Stat(r.Context(), fileName)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, storage.ErrInvalidName) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "stat frame", "file", fileName, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var etag string
+	if IsValidFileName(fileName) {
+		etag = `"` + HashFromFileName(fileName) + `"`
+	}
+	if etag != "" && matchesETag(r, etag) {
+		setCaching(w, etag, cacheControl)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Backends that can presign send the client to the object itself.
+	if presigner, ok := store.(storage.Presigner); ok {
+		location, err := presigner.PresignGet(r.Context(), fileName)
+		if err == nil {
+			usage.Downloaded(fileName)
+			http.Redirect(w, r, location, http.StatusTemporaryRedirect)
+			return
+		}
+		if !errors.Is(err, errors.ErrUnsupported) {
+			slog.ErrorContext(r.Context(), "presign frame", "file", fileName, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	file, err := store.Open(r.Context(), fileName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "open frame", "file", fileName, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	usage.Downloaded(fileName)
+	if etag != "" {
+		setCaching(w, etag, cacheControl)
+	}
+	http.ServeContent(w, r, fileName, info.ModTime, file)
+}
@@ -0,0 +1,159 @@
+package frame
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"AnimeFrameBot/internal/catalog"
+	"AnimeFrameBot/internal/storage"
+)
+
+// indexTTL bounds how long frames are cached for backends that cannot report
+// whether they changed.
+const indexTTL = 30 * time.Second
+
+// Index caches the frames of a storage backend. The backend is scanned again
+// when its version changes, i.e. when frames are added, removed or renamed,
+// or after indexTTL if the backend is not a storage.Versioner. Changes to the
+// catalog trigger a scan as well.
+type Index struct {
+	store   storage.Backend
+	catalog *catalog.Catalog
+
+	mu       sync.Mutex
+	frames   []Frame
+	byHash   []hashedName
+	version  string
+	loadedAt time.Time
+	err      error
+}
+
+// NewIndex returns an index of the frames in store. With a catalog, the
+// subtitles are taken from it and new frames are added to it; cat may be nil.
+func NewIndex(store storage.Backend, cat *catalog.Catalog) *Index {
+	return &Index{store: store, catalog: cat}
+}
+
+func (idx *Index) currentVersion(ctx context.Context) (string, bool, error) {
+	var version string
+	if idx.catalog != nil {
+		catVersion, err := idx.catalog.Version()
+		if err != nil {
+			return "", false, err
+		}
+		version = strconv.FormatUint(catVersion, 10) + "/"
+	}
+	versioner, ok := idx.store.(storage.Versioner)
+	if !ok {
+		return version, false, nil
+	}
+	storeVersion, err := versioner.Version(ctx)
+	return version + storeVersion, true, err
+}
+
+// Frames returns the frames of the backend, scanning it if it changed since
+// the last scan.
+func (idx *Index) Frames(ctx context.Context) ([]Frame, error) {
+	version, versioned, err := idx.currentVersion(ctx)
+	if err != nil {
+		idx.mu.Lock()
+		idx.err = err
+		idx.mu.Unlock()
+		return nil, err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.err == nil && !idx.loadedAt.IsZero() && version == idx.version {
+		if versioned || time.Since(idx.loadedAt) < indexTTL {
+			return idx.frames, nil
+		}
+	}
+
+	// The version is taken before scanning, so frames added during the scan,
+	// and the renames done by it, trigger another scan next time.
+	frames, err := initFrames(ctx, idx.store, idx.catalog)
+	idx.err = err
+	if err != nil {
+		return nil, err
+	}
+	idx.frames = frames
+	idx.byHash = sortByHash(frames)
+	idx.version = version
+	idx.loadedAt = time.Now()
+	return frames, nil
+}
+
+// hashedName is the name of a frame with its content hash.
+type hashedName struct {
+	hash string
+	name string
+}
+
+func sortByHash(frames []Frame) []hashedName {
+	byHash := make([]hashedName, 0, len(frames))
+	for _, f := range frames {
+		byHash = append(byHash, hashedName{hash: HashFromFileName(f.Filename), name: f.Filename})
+	}
+	sort.Slice(byHash, func(i, j int) bool {
+		if byHash[i].hash != byHash[j].hash {
+			return byHash[i].hash < byHash[j].hash
+		}
+		return byHash[i].name < byHash[j].name
+	})
+	return byHash
+}
+
+// ErrAmbiguousHash is returned by Resolve if frames with different content
+// match a hash prefix.
+var ErrAmbiguousHash = errors.New("hash prefix matches more than one frame")
+
+// Resolve returns the name of the frame whose content hash starts with prefix,
+// or "" if there is none. Frames with the same content are interchangeable, so
+// one of them is returned.
+func (idx *Index) Resolve(ctx context.Context, prefix string) (string, error) {
+	if _, err := idx.Frames(ctx); err != nil {
+		return "", err
+	}
+	idx.mu.Lock()
+	byHash := idx.byHash
+	idx.mu.Unlock()
+
+	i := sort.Search(len(byHash), func(i int) bool { return byHash[i].hash >= prefix })
+	if i == len(byHash) || !strings.HasPrefix(byHash[i].hash, prefix) {
+		return "", nil
+	}
+	for _, other := range byHash[i+1:] {
+		if !strings.HasPrefix(other.hash, prefix) {
+			break
+		}
+		if other.hash != byHash[i].hash {
+			return "", ErrAmbiguousHash
+		}
+	}
+	return byHash[i].name, nil
+}
+
+type IndexStatus struct {
+	Loaded   bool
+	Frames   int
+	LoadedAt time.Time
+	Err      error
+}
+
+// Status describes the last scan without scanning.
+func (idx *Index) Status() IndexStatus {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return IndexStatus{
+		Loaded:   idx.err == nil && !idx.loadedAt.IsZero(),
+		Frames:   len(idx.frames),
+		LoadedAt: idx.loadedAt,
+		Err:      idx.err,
+	}
+}
@@ -0,0 +1,150 @@
+package frame
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// maxSessionToken is the maximum length of a shuffle session token.
+const maxSessionToken = 64
+
+type clientKey struct{}
+
+// WithClient returns a copy of ctx identifying the client of a request, whose
+// shuffle sessions are kept apart from those of other clients.
+func WithClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// clientFromContext returns the client set by WithClient, or "" for requests
+// without one, which share their sessions.
+func clientFromContext(ctx context.Context) string {
+	client, _ := ctx.Value(clientKey{}).(string)
+	return client
+}
+
+type shuffleSession struct {
+	// seen holds the names of the frames returned in the current cycle.
+	seen     map[string]bool
+	lastUsed time.Time
+}
+
+// Sessions keeps shuffle sessions in memory, so that a client picking random
+// frames with the same token gets every frame once before any repeats. Each
+// client has its own tokens. Sessions unused for the TTL are dropped; when
+// there are too many, the least recently used one is dropped first.
+type Sessions struct {
+	mu          sync.Mutex
+	ttl         time.Duration
+	maxSessions int
+	sessions    map[string]*shuffleSession
+	now         func() time.Time
+}
+
+// NewSessions returns an empty session store keeping at most maxSessions.
+func NewSessions(ttl time.Duration, maxSessions int) *Sessions {
+	return &Sessions{
+		ttl:         ttl,
+		maxSessions: maxSessions,
+		sessions:    make(map[string]*shuffleSession),
+		now:         time.Now,
+	}
+}
+
+// Pick returns numFrames random frames not yet returned in the session of
+// client and token, weighted by weights unless it is nil. Once every frame has
+// been returned a new cycle starts; a call spanning two cycles does not return
+// the same frame twice.
+func (s *Sessions) Pick(client, token string, rng *rand.Rand, frames []Frame, weights []float64, numFrames int) ([]Frame, error) {
+	if numFrames > len(frames) || numFrames < 0 {
+		return nil, fmt.Errorf("invalid number of frames: %d", numFrames)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess := s.session(client + "\x00" + token)
+	unseen, unseenWeights := filterFrames(frames, weights, func(f Frame) bool { return !sess.seen[f.Filename] })
+	picked, err := pickFrames(rng, unseen, unseenWeights, min(numFrames, len(unseen)))
+	if err != nil {
+		return nil, err
+	}
+	if len(picked) < numFrames {
+		taken := make(map[string]bool, len(picked))
+		for _, f := range picked {
+			taken[f.Filename] = true
+		}
+		rest, restWeights := filterFrames(frames, weights, func(f Frame) bool { return !taken[f.Filename] })
+		next, err := pickFrames(rng, rest, restWeights, numFrames-len(picked))
+		if err != nil {
+			return nil, err
+		}
+		picked = append(picked, next...)
+		sess.seen = make(map[string]bool, len(frames))
+		for _, f := range next {
+			sess.seen[f.Filename] = true
+		}
+	} else {
+		for _, f := range picked {
+			sess.seen[f.Filename] = true
+		}
+	}
+	return picked, nil
+}
+
+// filterFrames returns the frames that keep reports true for, and their
+// weights if weights is not nil.
+func filterFrames(frames []Frame, weights []float64, keep func(Frame) bool) ([]Frame, []float64) {
+	var kept []Frame
+	var keptWeights []float64
+	if weights != nil {
+		keptWeights = []float64{}
+	}
+	for i, f := range frames {
+		if !keep(f) {
+			continue
+		}
+		kept = append(kept, f)
+		if weights != nil {
+			keptWeights = append(keptWeights, weights[i])
+		}
+	}
+	return kept, keptWeights
+}
+
+// session returns the session stored under key, creating it if needed. The
+// caller holds s.mu.
+func (s *Sessions) session(key string) *shuffleSession {
+	now := s.now()
+	if sess, ok := s.sessions[key]; ok && now.Sub(sess.lastUsed) < s.ttl {
+		sess.lastUsed = now
+		return sess
+	}
+	if len(s.sessions) >= s.maxSessions {
+		s.evict(now)
+	}
+	sess := &shuffleSession{seen: map[string]bool{}, lastUsed: now}
+	s.sessions[key] = sess
+	return sess
+}
+
+// evict drops the expired sessions, or the least recently used one if none
+// has expired. The caller holds s.mu.
+func (s *Sessions) evict(now time.Time) {
+	var oldest string
+	for key, sess := range s.sessions {
+		if now.Sub(sess.lastUsed) >= s.ttl {
+			delete(s.sessions, key)
+			continue
+		}
+		if oldest == "" || sess.lastUsed.Before(s.sessions[oldest].lastUsed) {
+			oldest = key
+		}
+	}
+	if len(s.sessions) >= s.maxSessions {
+		delete(s.sessions, oldest)
+	}
+}
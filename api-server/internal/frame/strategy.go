@@ -0,0 +1,188 @@
+package frame
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+const (
+	// recentHalfLife is the age at which the recent strategy weighs a frame
+	// half as much as a new one.
+	recentHalfLife = 30 * 24 * time.Hour
+	// tagBoost is how much more the tags strategy weighs tagged frames.
+	tagBoost = 10
+)
+
+// ErrInvalidStrategy is returned for unknown strategies and strategy
+// parameters that do not make sense; the client has to change the request.
+var ErrInvalidStrategy = errors.New("invalid strategy")
+
+// Strategy weights frames for random picks. Weights returns one weight per
+// frame, in the same order. Frames are picked with a probability proportional
+// to their weight; frames weighing 0 are picked only when no others are left.
+// query holds the request parameters, for strategies that take any.
+type Strategy interface {
+	Weights(ctx context.Context, query url.Values, frames []Frame) ([]float64, error)
+}
+
+// Strategies are the strategies selectable by name with ?strategy=.
+type Strategies map[string]Strategy
+
+// DefaultStrategies returns the popular, recent and tags strategies.
+func DefaultStrategies(usage *Usage) Strategies {
+	return Strategies{
+		"popular": NewPopular(usage),
+		"recent":  Recent{HalfLife: recentHalfLife},
+		"tags":    Tagged{Boost: tagBoost},
+	}
+}
+
+// weights returns the weights of the strategy named in the request, or nil
+// without one.
+func (s Strategies) weights(r *http.Request, frames []Frame) ([]float64, error) {
+	name := r.URL.Query().Get("strategy")
+	if name == "" {
+		return nil, nil
+	}
+	strategy, ok := s[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown strategy %q", ErrInvalidStrategy, name)
+	}
+	weights, err := strategy.Weights(r.Context(), r.URL.Query(), frames)
+	if err != nil {
+		return nil, err
+	}
+	if len(weights) != len(frames) {
+		return nil, fmt.Errorf("strategy %s returned %d weights for %d frames", name, len(weights), len(frames))
+	}
+	return weights, nil
+}
+
+// Popular favors frames that are downloaded often: a frame weighs one more
+// than its downloads, as counted by usage.
+type Popular struct {
+	usage *Usage
+}
+
+func NewPopular(usage *Usage) Popular {
+	return Popular{usage: usage}
+}
+
+func (p Popular) Weights(_ context.Context, _ url.Values, frames []Frame) ([]float64, error) {
+	downloads, err := p.usage.counts(counterDownloads)
+	if err != nil {
+		return nil, err
+	}
+	weights := make([]float64, len(frames))
+	for i, f := range frames {
+		weights[i] = 1 + float64(downloads[f.Filename])
+	}
+	return weights, nil
+}
+
+// Recent favors frames added recently: the weight of a frame halves with every
+// HalfLife of its age.
+type Recent struct {
+	HalfLife time.Duration
+	now      func() time.Time
+}
+
+func (s Recent) Weights(_ context.Context, _ url.Values, frames []Frame) ([]float64, error) {
+	now := time.Now()
+	if s.now != nil {
+		now = s.now()
+	}
+	weights := make([]float64, len(frames))
+	for i, f := range frames {
+		age := max(now.Sub(f.AddedAt), 0)
+		weights[i] = math.Exp2(-age.Hours() / s.HalfLife.Hours())
+	}
+	return weights, nil
+}
+
+// Tagged favors frames with any of the tags given as tag parameters, e.g. the
+// tag of a series: they weigh Boost, other frames 1.
+type Tagged struct {
+	Boost float64
+}
+
+func (s Tagged) Weights(_ context.Context, query url.Values, frames []Frame) ([]float64, error) {
+	tags := query["tag"]
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("%w: tags needs at least one tag parameter", ErrInvalidStrategy)
+	}
+	boosted := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		boosted[tag] = true
+	}
+	weights := make([]float64, len(frames))
+	for i, f := range frames {
+		weights[i] = 1
+		for _, tag := range f.Tags {
+			if boosted[tag] {
+				weights[i] = s.Boost
+				break
+			}
+		}
+	}
+	return weights, nil
+}
+
+// pickFrames picks numFrames distinct frames, weighted by weights or uniformly
+// if weights is nil.
+func pickFrames(rng *rand.Rand, frames []Frame, weights []float64, numFrames int) ([]Frame, error) {
+	if weights == nil {
+		return getRandomFrames(rng, frames, numFrames)
+	}
+	return getWeightedFrames(rng, frames, weights, numFrames)
+}
+
+// getWeightedFrames picks numFrames distinct frames one after another, each
+// with a probability proportional to its weight among the frames left. Every
+// frame draws an exponential key with its weight as rate, and the smallest
+// keys win, which amounts to the same. The same rng and frames always give
+// the same picks; a nil rng uses the global source.
+func getWeightedFrames(rng *rand.Rand, frames []Frame, weights []float64, numFrames int) ([]Frame, error) {
+	if numFrames > len(frames) || numFrames < 0 {
+		return nil, fmt.Errorf("invalid number of frames: %d", numFrames)
+	}
+
+	exp := rand.ExpFloat64
+	if rng != nil {
+		exp = rng.ExpFloat64
+	}
+	type keyedFrame struct {
+		frame Frame
+		// unweighted frames come after all others, in random order.
+		unweighted bool
+		key        float64
+	}
+	keyed := make([]keyedFrame, len(frames))
+	for i, f := range frames {
+		keyed[i] = keyedFrame{frame: f, key: exp()}
+		if weights[i] > 0 {
+			keyed[i].key /= weights[i]
+		} else {
+			keyed[i].unweighted = true
+		}
+	}
+	sort.SliceStable(keyed, func(i, j int) bool {
+		if keyed[i].unweighted != keyed[j].unweighted {
+			return !keyed[i].unweighted
+		}
+		return keyed[i].key < keyed[j].key
+	})
+
+	weightedFrames := []Frame{}
+	for _, k := range keyed[:numFrames] {
+		weightedFrames = append(weightedFrames, k.frame)
+	}
+	return weightedFrames, nil
+}
@@ -0,0 +1,285 @@
+package frame
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"AnimeFrameBot/internal/catalog"
+)
+
+// Counters of the catalog kept by Usage.
+const (
+	counterSearches  = "searches"
+	counterDownloads = "downloads"
+)
+
+const (
+	// maxQueryLength is the length of the longest query counted, in bytes.
+	maxQueryLength = 200
+	// maxPendingQueries bounds the distinct queries counted between flushes;
+	// further new queries are not counted.
+	maxPendingQueries = 10000
+)
+
+// Usage counts how often each frame is returned by searches and downloaded,
+// and how often each query is searched. Counts are kept in memory and added to
+// the catalog by Flush, so that serving a frame does not write to the
+// database. Without a catalog, counts are only kept in memory and are lost on
+// restart.
+type Usage struct {
+	catalog *catalog.Catalog
+
+	mu sync.Mutex
+	// frames holds counter values by counter name by frame name, and queries
+	// the counts of normalized queries, not yet flushed.
+	frames  map[string]map[string]uint64
+	queries map[string]uint64
+	// flushed caches the values of each counter in the catalog, so that
+	// weighting frames does not scan the catalog on every request. Flush
+	// drops it and bumps generation.
+	flushed    map[string]map[string]uint64
+	generation int
+}
+
+// NewUsage returns a usage counter flushing to cat, which may be nil.
+func NewUsage(cat *catalog.Catalog) *Usage {
+	return &Usage{
+		catalog: cat,
+		frames:  map[string]map[string]uint64{},
+		queries: map[string]uint64{},
+		flushed: map[string]map[string]uint64{},
+	}
+}
+
+func (u *Usage) count(name, counter string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	counters := u.frames[name]
+	if counters == nil {
+		counters = map[string]uint64{}
+		u.frames[name] = counters
+	}
+	counters[counter]++
+}
+
+// Searched counts frames as returned by a search for query, which is "" for
+// searches without one.
+func (u *Usage) Searched(query string, frames []Frame) {
+	for _, f := range frames {
+		u.count(f.Filename, counterSearches)
+	}
+	query = normalizeQuery(query)
+	if query == "" || len(query) > maxQueryLength {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.queries[query]; ok || len(u.queries) < maxPendingQueries {
+		u.queries[query]++
+	}
+}
+
+// Downloaded counts a download of the frame stored under name.
+func (u *Usage) Downloaded(name string) {
+	u.count(name, counterDownloads)
+}
+
+func normalizeQuery(query string) string {
+	return strings.Join(strings.Fields(strings.ToLower(query)), " ")
+}
+
+// Flush adds the counts to the catalog. Counts that could not be added are
+// kept for the next flush.
+func (u *Usage) Flush() error {
+	if u.catalog == nil {
+		return nil
+	}
+	u.mu.Lock()
+	frames, queries := u.frames, u.queries
+	u.frames, u.queries = map[string]map[string]uint64{}, map[string]uint64{}
+	u.mu.Unlock()
+
+	err := u.catalog.AddCounters(frames)
+	if err == nil {
+		frames = nil
+		err = u.catalog.AddQueries(queries)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.flushed = map[string]map[string]uint64{}
+	u.generation++
+	if err == nil {
+		return nil
+	}
+	for name, counters := range frames {
+		for counter, n := range counters {
+			if u.frames[name] == nil {
+				u.frames[name] = map[string]uint64{}
+			}
+			u.frames[name][counter] += n
+		}
+	}
+	for query, n := range queries {
+		u.queries[query] += n
+	}
+	return err
+}
+
+// Run flushes the counts every interval until ctx is done. The caller flushes
+// once more after serving the last request.
+func (u *Usage) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := u.Flush(); err != nil {
+				slog.ErrorContext(ctx, "flush usage", "error", err)
+			}
+		}
+	}
+}
+
+// counts returns the values of a counter for every frame, flushed or not.
+func (u *Usage) counts(counter string) (map[string]uint64, error) {
+	flushed, err := u.flushedCounts(counter)
+	if err != nil {
+		return nil, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	counts := make(map[string]uint64, len(flushed))
+	for name, n := range flushed {
+		counts[name] = n
+	}
+	for name, counters := range u.frames {
+		if n := counters[counter]; n > 0 {
+			counts[name] += n
+		}
+	}
+	return counts, nil
+}
+
+// flushedCounts returns the values of a counter in the catalog, from the cache
+// if they were read since the last flush. The map must not be modified.
+func (u *Usage) flushedCounts(counter string) (map[string]uint64, error) {
+	if u.catalog == nil {
+		return nil, nil
+	}
+	u.mu.Lock()
+	cached, ok := u.flushed[counter]
+	generation := u.generation
+	u.mu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	values, err := u.catalog.CounterValues(counter)
+	if err != nil {
+		return nil, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	// Values read while a flush was adding counts may miss them.
+	if u.generation == generation {
+		u.flushed[counter] = values
+	}
+	return values, nil
+}
+
+// queryCounts returns the counts of every query, flushed or not.
+func (u *Usage) queryCounts() (map[string]uint64, error) {
+	counts := map[string]uint64{}
+	if u.catalog != nil {
+		var err error
+		counts, err = u.catalog.Queries()
+		if err != nil {
+			return nil, err
+		}
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for query, n := range u.queries {
+		counts[query] += n
+	}
+	return counts, nil
+}
+
+// FrameUsage is how often a frame was used.
+type FrameUsage struct {
+	Name      string `json:"name"`
+	Subtitle  string `json:"subtitle"`
+	Searches  uint64 `json:"searches"`
+	Downloads uint64 `json:"downloads"`
+}
+
+// QueryUsage is how often a query was searched.
+type QueryUsage struct {
+	Query string `json:"query"`
+	Count uint64 `json:"count"`
+}
+
+// TopFrames returns up to limit frames of index used most by counter, which is
+// "searches" or "downloads", most used first. Frames never used that way are
+// left out.
+func (u *Usage) TopFrames(ctx context.Context, index *Index, counter string, limit int) ([]FrameUsage, error) {
+	frames, err := index.Frames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	searches, err := u.counts(counterSearches)
+	if err != nil {
+		return nil, err
+	}
+	downloads, err := u.counts(counterDownloads)
+	if err != nil {
+		return nil, err
+	}
+	by := map[string]map[string]uint64{counterSearches: searches, counterDownloads: downloads}[counter]
+
+	top := []FrameUsage{}
+	for _, f := range frames {
+		if by[f.Filename] == 0 {
+			continue
+		}
+		top = append(top, FrameUsage{
+			Name:      f.Filename,
+			Subtitle:  f.Subtitle,
+			Searches:  searches[f.Filename],
+			Downloads: downloads[f.Filename],
+		})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if by[top[i].Name] != by[top[j].Name] {
+			return by[top[i].Name] > by[top[j].Name]
+		}
+		return top[i].Name < top[j].Name
+	})
+	return top[:min(limit, len(top))], nil
+}
+
+// TopQueries returns up to limit queries searched most, most searched first.
+func (u *Usage) TopQueries(limit int) ([]QueryUsage, error) {
+	counts, err := u.queryCounts()
+	if err != nil {
+		return nil, err
+	}
+	top := make([]QueryUsage, 0, len(counts))
+	for query, n := range counts {
+		top = append(top, QueryUsage{Query: query, Count: n})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Query < top[j].Query
+	})
+	return top[:min(limit, len(top))], nil
+}
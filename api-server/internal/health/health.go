@@ -0,0 +1,114 @@
+package health
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"AnimeFrameBot/internal/frame"
+	"AnimeFrameBot/internal/storage"
+)
+
+const readyProbe = ".readyz"
+
+// writeProbeInterval is how long StorageWritable reuses its last result, so
+// that frequent probes do not write to storage on every request.
+const writeProbeInterval = 5 * time.Second
+
+// Check is one readiness condition. Run returns nil when the condition holds.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// IndexLoaded checks that the frame index can be loaded from storage.
+func IndexLoaded(index *frame.Index) Check {
+	return Check{
+		Name: "index",
+		Run: func(ctx context.Context) error {
+			_, err := index.Frames(ctx)
+			return err
+		},
+	}
+}
+
+// StorageReadable checks that the frames of store can be listed.
+func StorageReadable(store storage.Backend) Check {
+	return Check{
+		Name: "storage_readable",
+		Run: func(ctx context.Context) error {
+			_, err := store.List(ctx, readyProbe)
+			return err
+		},
+	}
+}
+
+// StorageWritable checks that store accepts writes, with its WriteProber if
+// it has one. Otherwise it stores and deletes a hidden object under a unique
+// name, so concurrent probes do not interfere; hidden objects are ignored by
+// the frame index. The result is reused for writeProbeInterval.
+func StorageWritable(store storage.Backend) Check {
+	var (
+		mu      sync.Mutex
+		checked time.Time
+		last    error
+	)
+	return Check{
+		Name: "storage_writable",
+		Run: func(ctx context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if !checked.IsZero() && time.Since(checked) < writeProbeInterval {
+				return last
+			}
+			last = probeWrite(ctx, store)
+			checked = time.Now()
+			return last
+		},
+	}
+}
+
+func probeWrite(ctx context.Context, store storage.Backend) error {
+	if prober, ok := store.(storage.WriteProber); ok {
+		return prober.ProbeWrite(ctx)
+	}
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := readyProbe + "-" + hex.EncodeToString(suffix)
+	if _, err := store.Put(ctx, name, strings.NewReader("ok")); err != nil {
+		return err
+	}
+	return store.Delete(ctx, name)
+}
+
+// MinFreeSpace checks that store has at least min bytes available. Backends
+// without a notion of free space always pass.
+func MinFreeSpace(store storage.Backend, min uint64) Check {
+	return Check{
+		Name: "disk_space",
+		Run: func(ctx context.Context) error {
+			spacer, ok := store.(storage.FreeSpacer)
+			if !ok {
+				return nil
+			}
+			free, err := spacer.FreeBytes(ctx)
+			if errors.Is(err, errors.ErrUnsupported) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if free < min {
+				return fmt.Errorf("%d bytes free, below the minimum of %d", free, min)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,141 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"AnimeFrameBot/internal/frame"
+	"AnimeFrameBot/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingStore fails every operation.
+type failingStore struct {
+	storage.Backend
+}
+
+func (failingStore) List(context.Context, string) ([]storage.ObjectInfo, error) {
+	return nil, errors.New("unavailable")
+}
+
+func (failingStore) Put(context.Context, string, io.Reader) (int64, error) {
+	return 0, errors.New("unavailable")
+}
+
+// plainStore hides the optional interfaces of its backend.
+type plainStore struct {
+	storage.Backend
+}
+
+func TestChecks(t *testing.T) {
+	store := storage.NewMemory()
+	local := storage.NewLocal(t.TempDir())
+
+	tests := []struct {
+		name   string
+		check  Check
+		expect bool
+	}{
+		{name: "index loaded", check: IndexLoaded(frame.NewIndex(store, nil)), expect: true},
+		{name: "index failing store", check: IndexLoaded(frame.NewIndex(failingStore{}, nil)), expect: false},
+		{name: "readable", check: StorageReadable(store), expect: true},
+		{name: "not readable", check: StorageReadable(failingStore{}), expect: false},
+		{name: "writable", check: StorageWritable(store), expect: true},
+		{name: "writable local", check: StorageWritable(local), expect: true},
+		{name: "writable without prober", check: StorageWritable(plainStore{store}), expect: true},
+		{name: "not writable", check: StorageWritable(failingStore{}), expect: false},
+		{name: "enough space", check: MinFreeSpace(local, 0), expect: true},
+		{name: "not enough space", check: MinFreeSpace(local, math.MaxUint64), expect: false},
+		{name: "unlimited space", check: MinFreeSpace(store, math.MaxUint64), expect: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.check.Run(context.Background())
+			assert.Equal(t, tt.expect, err == nil, err)
+		})
+	}
+
+	// The writable check cleans up after itself.
+	objects, err := store.List(context.Background(), "")
+	require.NoError(t, err)
+	assert.Empty(t, objects)
+}
+
+func TestHandleLive(t *testing.T) {
+	w := httptest.NewRecorder()
+	HandleLive().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "ok"}`, w.Body.String())
+}
+
+func TestHandleReady(t *testing.T) {
+	pass := Check{Name: "pass", Run: func(context.Context) error { return nil }}
+	fail := Check{Name: "fail", Run: func(context.Context) error { return errors.New("broken") }}
+
+	tests := []struct {
+		name       string
+		checks     []Check
+		wantStatus int
+		wantBody   Readiness
+	}{
+		{
+			name:       "ready",
+			checks:     []Check{pass},
+			wantStatus: http.StatusOK,
+			wantBody:   Readiness{Ready: true, Checks: map[string]CheckResult{"pass": {OK: true}}},
+		},
+		{
+			name:       "not ready",
+			checks:     []Check{pass, fail},
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody: Readiness{Ready: false, Checks: map[string]CheckResult{
+				"pass": {OK: true},
+				"fail": {OK: false, Error: "broken"},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			HandleReady(tt.checks).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			assert.Equal(t, tt.wantStatus, w.Code)
+
+			var body Readiness
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, tt.wantBody, body)
+		})
+	}
+}
+
+func TestHandleVersion(t *testing.T) {
+	store := storage.NewMemory()
+	for _, name := range []string{"a.png", "b.png"} {
+		_, err := store.Put(context.Background(), name, strings.NewReader(name))
+		require.NoError(t, err)
+	}
+	started := time.Now().Add(-time.Minute)
+
+	w := httptest.NewRecorder()
+	HandleVersion(frame.NewIndex(store, nil), started).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var v Version
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &v))
+	assert.Equal(t, 2, v.Frames)
+	assert.NotEmpty(t, v.GoVersion)
+	assert.NotEmpty(t, v.Module)
+	assert.GreaterOrEqual(t, v.UptimeSeconds, 60.0)
+	assert.Equal(t, started.UTC().Format(time.RFC3339), v.StartedAt)
+}
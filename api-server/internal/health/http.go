@@ -0,0 +1,105 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"AnimeFrameBot/internal/frame"
+)
+
+type CheckResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type Readiness struct {
+	Ready  bool                   `json:"ready"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+type Version struct {
+	Module        string  `json:"module"`
+	Version       string  `json:"version"`
+	GoVersion     string  `json:"go_version"`
+	Revision      string  `json:"revision,omitempty"`
+	RevisionTime  string  `json:"revision_time,omitempty"`
+	Modified      bool    `json:"modified"`
+	Frames        int     `json:"frames"`
+	StartedAt     string  `json:"started_at"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(bytes)
+}
+
+// HandleLive reports that the process is up and serving requests.
+func HandleLive() http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		})
+}
+
+// HandleReady runs every check and responds 503 if any of them fails.
+func HandleReady(checks []Check) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			readiness := Readiness{Ready: true, Checks: make(map[string]CheckResult)}
+			for _, check := range checks {
+				result := CheckResult{OK: true}
+				if err := check.Run(r.Context()); err != nil {
+					result = CheckResult{OK: false, Error: err.Error()}
+					readiness.Ready = false
+				}
+				readiness.Checks[check.Name] = result
+			}
+
+			status := http.StatusOK
+			if !readiness.Ready {
+				status = http.StatusServiceUnavailable
+			}
+			writeJSON(w, status, readiness)
+		})
+}
+
+// HandleVersion reports the build information of the binary, the number of
+// frames in the index and the uptime since started.
+func HandleVersion(index *frame.Index, started time.Time) http.HandlerFunc {
+	version := Version{Module: "AnimeFrameBot", Version: "(unknown)"}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version.Module = info.Main.Path
+		version.Version = info.Main.Version
+		version.GoVersion = info.GoVersion
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				version.Revision = setting.Value
+			case "vcs.time":
+				version.RevisionTime = setting.Value
+			case "vcs.modified":
+				version.Modified = setting.Value == "true"
+			}
+		}
+	}
+	version.StartedAt = started.UTC().Format(time.RFC3339)
+
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			v := version
+			// The count is informational, a failing scan is reported by /readyz.
+			frames, _ := index.Frames(r.Context())
+			v.Frames = len(frames)
+			v.UptimeSeconds = time.Since(started).Seconds()
+			writeJSON(w, http.StatusOK, v)
+		})
+}
@@ -0,0 +1,99 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		input       string
+		expect      slog.Level
+		expectError string
+	}{
+		{input: "debug", expect: slog.LevelDebug},
+		{input: "INFO", expect: slog.LevelInfo},
+		{input: " warn ", expect: slog.LevelWarn},
+		{input: "error", expect: slog.LevelError},
+		{input: "verbose", expectError: `invalid log level: "verbose"`},
+		{input: "", expectError: `invalid log level: ""`},
+	}
+
+	for _, tt := range tests {
+		level, err := ParseLevel(tt.input)
+		if tt.expectError != "" {
+			assert.EqualError(t, err, tt.expectError)
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expect, level)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, slog.LevelInfo)
+
+	logger.DebugContext(context.Background(), "hidden")
+	logger.With("component", "test").InfoContext(WithRequestID(context.Background(), "abc"), "shown", "n", 1)
+	logger.WithGroup("g").Info("no request")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Equal(t, 2, len(lines))
+
+	var record map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, "shown", record["msg"])
+	assert.Equal(t, "abc", record["request_id"])
+	assert.Equal(t, "test", record["component"])
+	assert.Equal(t, float64(1), record["n"])
+
+	record = nil
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &record))
+	assert.NotContains(t, record, "request_id")
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    string
+		expectSet bool
+	}{
+		{name: "taken from header", header: "bot-42", expectSet: true},
+		{name: "generated", header: ""},
+		{name: "control characters", header: "bad\tid"},
+		{name: "too long", header: strings.Repeat("a", 129)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = RequestID(r.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set(RequestIDHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, got, w.Header().Get(RequestIDHeader))
+			if tt.expectSet {
+				assert.Equal(t, tt.header, got)
+			} else {
+				assert.Len(t, got, 32)
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// Handler serves the Default registry in the Prometheus text format.
+func Handler() http.HandlerFunc {
+	return HandlerFor(Default)
+}
+
+func HandlerFor(r *Registry) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			var buf bytes.Buffer
+			if err := r.Write(&buf); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+			_, _ = w.Write(buf.Bytes())
+		})
+}
@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounter(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests served.", "route", "status")
+	c.Inc("GET /a", "200")
+	c.Inc("GET /a", "200")
+	c.Add(3, "GET /b", "404")
+	c.Add(-1, "GET /b", "404")
+
+	var b strings.Builder
+	require.NoError(t, r.Write(&b))
+	assert.Equal(t, `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{route="GET /a",status="200"} 2
+requests_total{route="GET /b",status="404"} 3
+`, b.String())
+}
+
+func TestGauge(t *testing.T) {
+	r := NewRegistry()
+	g := r.NewGauge("index_frames", "Frames in the index.")
+	g.Set(10)
+	g.Set(7)
+
+	var b strings.Builder
+	require.NoError(t, r.Write(&b))
+	assert.Equal(t, `# HELP index_frames Frames in the index.
+# TYPE index_frames gauge
+index_frames 7
+`, b.String())
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogram("results", "Results per search.", []float64{5, 1}, "mode")
+	h.Observe(0, "fuzzy")
+	h.Observe(3, "fuzzy")
+	h.Observe(10, "fuzzy")
+
+	var b strings.Builder
+	require.NoError(t, r.Write(&b))
+	assert.Equal(t, `# HELP results Results per search.
+# TYPE results histogram
+results_bucket{mode="fuzzy",le="1"} 1
+results_bucket{mode="fuzzy",le="5"} 2
+results_bucket{mode="fuzzy",le="+Inf"} 3
+results_sum{mode="fuzzy"} 13
+results_count{mode="fuzzy"} 3
+`, b.String())
+}
+
+func TestEscaping(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("escaped", "Line\nbreak and \\ backslash.", "value")
+	c.Inc("a \"quoted\"\nvalue\\")
+
+	var b strings.Builder
+	require.NoError(t, r.Write(&b))
+	assert.Equal(t, `# HELP escaped Line\nbreak and \\ backslash.
+# TYPE escaped counter
+escaped{value="a \"quoted\"\nvalue\\"} 1
+`, b.String())
+}
+
+func TestRegistryPanics(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("dup", "Duplicate.", "a")
+	assert.Panics(t, func() { r.NewGauge("dup", "Duplicate.") })
+	assert.Panics(t, func() { c.Inc("x", "y") })
+}
+
+func TestHandlerFor(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("hits_total", "Hits.").Inc()
+
+	w := httptest.NewRecorder()
+	HandlerFor(r).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "hits_total 1\n")
+}
@@ -0,0 +1,132 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"AnimeFrameBot/internal/auth"
+)
+
+// ClientID identifies the client by its API key name, or by its IP address
+// when the request is not authenticated.
+func ClientID(r *http.Request) string {
+	if key, ok := auth.FromContext(r.Context()); ok {
+		return "key:" + key.Name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
+
+// Limit rejects requests with 429 once the client has used up its budget for
+// class. A nil limiter disables rate limiting.
+func Limit(l *Limiter, class Class, next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, retryAfter := l.Allow(class, ClientID(r)); !ok {
+			tooManyRequests(w, retryAfter)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (w *statusWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+type chargeKey struct{}
+
+type charge struct {
+	files int
+	bytes int64
+	set   bool
+
+	quotas *Quotas
+	client string
+}
+
+// ChargeUploads sets what the current request is charged against the upload
+// quota, for handlers that store several files in one request. Without it,
+// LimitUploads charges one upload of the request body if the response is
+// 201 Created. Outside LimitUploads it does nothing.
+func ChargeUploads(ctx context.Context, files int, bytes int64) {
+	if c, ok := ctx.Value(chargeKey{}).(*charge); ok {
+		c.files, c.bytes, c.set = files, bytes, true
+	}
+}
+
+// WithinQuota reports whether the current request may store files uploads of
+// bytes in total without going over the daily quota of its client, for
+// handlers that store several files in one request. Outside LimitUploads it
+// always reports true.
+func WithinQuota(ctx context.Context, files int, bytes int64) bool {
+	c, ok := ctx.Value(chargeKey{}).(*charge)
+	if !ok {
+		return true
+	}
+	return c.quotas.Fits(c.client, files, bytes)
+}
+
+// LimitUploads rejects uploads with 429 once the client has used up its daily
+// quota, and charges the request body of every created upload against it, or
+// what the handler set with ChargeUploads. Nil quotas disable the check.
+func LimitUploads(q *Quotas, next http.Handler) http.Handler {
+	if q == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := ClientID(r)
+		if ok, retryAfter := q.Check(client); !ok {
+			tooManyRequests(w, retryAfter)
+			return
+		}
+
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		wrapped := &statusWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		c := &charge{quotas: q, client: client}
+		next.ServeHTTP(wrapped, r.WithContext(context.WithValue(r.Context(), chargeKey{}, c)))
+
+		switch {
+		case c.set:
+			if c.files > 0 {
+				q.RecordFiles(client, c.files, c.bytes)
+			}
+		case wrapped.statusCode == http.StatusCreated:
+			q.Record(client, body.n)
+		}
+	})
+}
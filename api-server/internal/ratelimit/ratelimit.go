@@ -0,0 +1,198 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type Class string
+
+const (
+	ClassSearch   Class = "search"
+	ClassDownload Class = "download"
+	ClassUpload   Class = "upload"
+	ClassChunk    Class = "chunk"
+)
+
+// Rate is a token bucket budget: Burst tokens refilled at PerSecond tokens per second.
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type bucketKey struct {
+	class  Class
+	client string
+}
+
+// sweepEvery is how many calls to Allow pass between removals of idle buckets.
+const sweepEvery = 1024
+
+type Limiter struct {
+	mu      sync.Mutex
+	rates   map[Class]Rate
+	buckets map[bucketKey]*bucket
+	calls   int
+	now     func() time.Time
+}
+
+// NewLimiter creates a limiter with one token bucket per class and client.
+// Classes without a rate are not limited.
+func NewLimiter(rates map[Class]Rate) *Limiter {
+	return &Limiter{
+		rates:   rates,
+		buckets: make(map[bucketKey]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of client in class. If the bucket is
+// empty it returns false and how long until the next token is available.
+func (l *Limiter) Allow(class Class, client string) (bool, time.Duration) {
+	rate, ok := l.rates[class]
+	if !ok {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.calls++
+	if l.calls%sweepEvery == 0 {
+		l.sweep(now)
+	}
+
+	key := bucketKey{class: class, client: client}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rate.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(rate.Burst), b.tokens+now.Sub(b.last).Seconds()*rate.PerSecond)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if rate.PerSecond <= 0 {
+		return false, time.Hour
+	}
+	wait := time.Duration((1 - b.tokens) / rate.PerSecond * float64(time.Second))
+	return false, wait
+}
+
+// sweep drops buckets that have refilled completely, they are equivalent to new ones.
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		rate := l.rates[key.class]
+		if b.tokens+now.Sub(b.last).Seconds()*rate.PerSecond >= float64(rate.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Quota is a per-client daily upload allowance. Zero values are unlimited.
+type Quota struct {
+	MaxBytes int64
+	MaxCount int
+}
+
+type usage struct {
+	bytes int64
+	count int
+}
+
+// Quotas tracks uploads per client for the current UTC day.
+type Quotas struct {
+	mu    sync.Mutex
+	quota Quota
+	day   string
+	usage map[string]*usage
+	now   func() time.Time
+}
+
+func NewQuotas(quota Quota) *Quotas {
+	return &Quotas{
+		quota: quota,
+		usage: make(map[string]*usage),
+		now:   time.Now,
+	}
+}
+
+// rollover resets the usage when the day has changed. Callers must hold q.mu.
+func (q *Quotas) rollover(now time.Time) {
+	day := now.UTC().Format(time.DateOnly)
+	if day != q.day {
+		q.day = day
+		q.usage = make(map[string]*usage)
+	}
+}
+
+// Check reports whether client may upload more today. If not, it also returns
+// the time left until the quota resets.
+func (q *Quotas) Check(client string) (bool, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now()
+	q.rollover(now)
+
+	u, ok := q.usage[client]
+	if !ok {
+		return true, 0
+	}
+	countExceeded := q.quota.MaxCount > 0 && u.count >= q.quota.MaxCount
+	bytesExceeded := q.quota.MaxBytes > 0 && u.bytes >= q.quota.MaxBytes
+	if !countExceeded && !bytesExceeded {
+		return true, 0
+	}
+
+	utc := now.UTC()
+	midnight := time.Date(utc.Year(), utc.Month(), utc.Day()+1, 0, 0, 0, 0, time.UTC)
+	return false, midnight.Sub(utc)
+}
+
+// Fits reports whether files more uploads of bytes in total stay within the
+// quota of client.
+func (q *Quotas) Fits(client string, files int, bytes int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover(q.now())
+	u, ok := q.usage[client]
+	if !ok {
+		u = &usage{}
+	}
+	if q.quota.MaxCount > 0 && u.count+files > q.quota.MaxCount {
+		return false
+	}
+	return q.quota.MaxBytes <= 0 || u.bytes+bytes <= q.quota.MaxBytes
+}
+
+// Record adds one upload of size bytes to the usage of client.
+func (q *Quotas) Record(client string, bytes int64) {
+	q.RecordFiles(client, 1, bytes)
+}
+
+// RecordFiles adds files uploads of bytes in total to the usage of client.
+func (q *Quotas) RecordFiles(client string, files int, bytes int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover(q.now())
+	u, ok := q.usage[client]
+	if !ok {
+		u = &usage{}
+		q.usage[client] = u
+	}
+	u.bytes += bytes
+	u.count += files
+}
@@ -0,0 +1,226 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"AnimeFrameBot/internal/auth"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func TestLimiterAllow(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	l := NewLimiter(map[Class]Rate{ClassSearch: {PerSecond: 1, Burst: 2}})
+	l.now = clock.now
+
+	ok, _ := l.Allow(ClassSearch, "a")
+	assert.True(t, ok)
+	ok, _ = l.Allow(ClassSearch, "a")
+	assert.True(t, ok)
+	ok, retryAfter := l.Allow(ClassSearch, "a")
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, retryAfter)
+
+	// Other clients and classes have their own budgets.
+	ok, _ = l.Allow(ClassSearch, "b")
+	assert.True(t, ok)
+	ok, _ = l.Allow(ClassDownload, "a")
+	assert.True(t, ok)
+
+	clock.t = clock.t.Add(500 * time.Millisecond)
+	ok, retryAfter = l.Allow(ClassSearch, "a")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+
+	clock.t = clock.t.Add(500 * time.Millisecond)
+	ok, _ = l.Allow(ClassSearch, "a")
+	assert.True(t, ok)
+
+	// Refilling never exceeds the burst.
+	clock.t = clock.t.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		ok, _ = l.Allow(ClassSearch, "a")
+		assert.True(t, ok)
+	}
+	ok, _ = l.Allow(ClassSearch, "a")
+	assert.False(t, ok)
+}
+
+func TestLimiterSweep(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	l := NewLimiter(map[Class]Rate{ClassSearch: {PerSecond: 1, Burst: 2}})
+	l.now = clock.now
+
+	l.Allow(ClassSearch, "a")
+	clock.t = clock.t.Add(time.Minute)
+	for i := 0; i < sweepEvery-1; i++ {
+		l.Allow(ClassSearch, "b")
+		clock.t = clock.t.Add(time.Millisecond)
+	}
+	_, ok := l.buckets[bucketKey{class: ClassSearch, client: "a"}]
+	assert.False(t, ok)
+	_, ok = l.buckets[bucketKey{class: ClassSearch, client: "b"}]
+	assert.True(t, ok)
+}
+
+func TestQuotas(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 6, 1, 18, 0, 0, 0, time.UTC)}
+
+	tests := []struct {
+		name    string
+		quota   Quota
+		uploads []int64
+		expect  bool
+	}{
+		{name: "unlimited", quota: Quota{}, uploads: []int64{1 << 30, 1 << 30}, expect: true},
+		{name: "below count", quota: Quota{MaxCount: 2}, uploads: []int64{1}, expect: true},
+		{name: "count reached", quota: Quota{MaxCount: 2}, uploads: []int64{1, 1}, expect: false},
+		{name: "below bytes", quota: Quota{MaxBytes: 100}, uploads: []int64{99}, expect: true},
+		{name: "bytes reached", quota: Quota{MaxBytes: 100}, uploads: []int64{60, 40}, expect: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewQuotas(tt.quota)
+			q.now = clock.now
+			for _, n := range tt.uploads {
+				q.Record("a", n)
+			}
+
+			ok, retryAfter := q.Check("a")
+			assert.Equal(t, tt.expect, ok)
+			if !tt.expect {
+				assert.Equal(t, 6*time.Hour, retryAfter)
+			}
+
+			ok, _ = q.Check("b")
+			assert.True(t, ok)
+		})
+	}
+}
+
+func TestQuotasReset(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 6, 1, 23, 59, 0, 0, time.UTC)}
+	q := NewQuotas(Quota{MaxCount: 1})
+	q.now = clock.now
+
+	q.Record("a", 1)
+	ok, _ := q.Check("a")
+	assert.False(t, ok)
+
+	clock.t = clock.t.Add(time.Minute)
+	ok, _ = q.Check("a")
+	assert.True(t, ok)
+}
+
+func TestClientID(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	assert.Equal(t, "ip:192.0.2.1", ClientID(req))
+
+	req = req.WithContext(auth.WithKey(context.Background(), auth.Key{Name: "bot"}))
+	assert.Equal(t, "key:bot", ClientID(req))
+}
+
+func TestLimit(t *testing.T) {
+	l := NewLimiter(map[Class]Rate{ClassSearch: {PerSecond: 0.5, Burst: 1}})
+	handler := Limit(l, ClassSearch, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+}
+
+func TestLimitUploads(t *testing.T) {
+	q := NewQuotas(Quota{MaxBytes: 10})
+	status := http.StatusBadRequest
+	handler := LimitUploads(q, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 64)
+		for {
+			if _, err := r.Body.Read(buf); err != nil {
+				break
+			}
+		}
+		w.WriteHeader(status)
+	}))
+
+	// Rejected uploads do not count towards the quota.
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("0123456789")))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	status = http.StatusCreated
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("0123456789")))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("0123456789")))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+}
+
+func TestChargeUploads(t *testing.T) {
+	q := NewQuotas(Quota{MaxCount: 3})
+	files := 2
+	handler := LimitUploads(q, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ChargeUploads(r.Context(), files, 100)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// Batches are charged per file, whatever their status.
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	ok, _ := q.Check(ClientID(httptest.NewRequest(http.MethodPost, "/", nil)))
+	assert.True(t, ok)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	// Without LimitUploads, charging does nothing.
+	ChargeUploads(context.Background(), 1, 1)
+}
+
+func TestWithinQuota(t *testing.T) {
+	q := NewQuotas(Quota{MaxCount: 3, MaxBytes: 100})
+	q.Record(ClientID(httptest.NewRequest(http.MethodPost, "/", nil)), 40)
+
+	var fits []bool
+	handler := LimitUploads(q, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fits = []bool{
+			WithinQuota(r.Context(), 2, 60),
+			WithinQuota(r.Context(), 3, 10),
+			WithinQuota(r.Context(), 1, 61),
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, []bool{true, false, false}, fits)
+
+	// Without LimitUploads, everything fits.
+	assert.True(t, WithinQuota(context.Background(), 1000, 1<<40))
+}
@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd)
+
+package storage
+
+import "errors"
+
+func freeBytes(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// probeDir is the directory ProbeWrite writes to. Directories are not objects.
+const probeDir = ".probe"
+
+// Local stores objects as files in a directory.
+type Local struct {
+	dir string
+}
+
+func NewLocal(dir string) *Local {
+	return &Local{dir: dir}
+}
+
+func (l *Local) Dir() string {
+	return l.dir
+}
+
+func (l *Local) path(op, name string) (string, error) {
+	if !validName(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: ErrInvalidName}
+	}
+	return filepath.Join(l.dir, name), nil
+}
+
+func (l *Local) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := []ObjectInfo{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// Removed since ReadDir.
+			continue
+		}
+		objects = append(objects, ObjectInfo{Name: entry.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return objects, nil
+}
+
+func (l *Local) Stat(ctx context.Context, name string) (ObjectInfo, error) {
+	path, err := l.path("stat", name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if info.IsDir() {
+		return ObjectInfo{}, &fs.PathError{Op: "stat", Path: path, Err: fs.ErrNotExist}
+	}
+	return ObjectInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (l *Local) Open(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	path, err := l.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+	}
+	return f, nil
+}
+
+// Put writes to a hidden temporary file first and renames it into place.
+func (l *Local) Put(ctx context.Context, name string, r io.Reader) (int64, error) {
+	path, err := l.path("put", name)
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(l.dir, ".put-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (l *Local) Delete(ctx context.Context, name string) error {
+	path, err := l.path("delete", name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (l *Local) Rename(ctx context.Context, oldName, newName string) error {
+	oldPath, err := l.path("rename", oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := l.path("rename", newName)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+// Version is the modification time of the directory, which changes whenever
+// a file is added, removed or renamed.
+func (l *Local) Version(ctx context.Context) (string, error) {
+	info, err := os.Stat(l.dir)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(info.ModTime().UnixNano(), 10), nil
+}
+
+// ProbeWrite writes and removes a temporary file in the hidden probeDir
+// inside the directory. Writing there leaves the modification time of the
+// directory, and so its version, unchanged once probeDir exists.
+func (l *Local) ProbeWrite(ctx context.Context) error {
+	dir := filepath.Join(l.dir, probeDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "write-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString("ok")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(f.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+func (l *Local) FreeBytes(ctx context.Context) (uint64, error) {
+	return freeBytes(l.dir)
+}
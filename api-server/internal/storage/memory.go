@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error {
+	return nil
+}
+
+// Memory keeps objects in memory. It is meant for tests.
+type Memory struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+	version int
+}
+
+func NewMemory() *Memory {
+	return &Memory{objects: make(map[string]memoryObject)}
+}
+
+func (m *Memory) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	objects := []ObjectInfo{}
+	for name, obj := range m.objects {
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, ObjectInfo{Name: name, Size: int64(len(obj.data)), ModTime: obj.modTime})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+	return objects, nil
+}
+
+func (m *Memory) get(op, name string) (memoryObject, error) {
+	if !validName(name) {
+		return memoryObject{}, &fs.PathError{Op: op, Path: name, Err: ErrInvalidName}
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	obj, ok := m.objects[name]
+	if !ok {
+		return memoryObject{}, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return obj, nil
+}
+
+func (m *Memory) Stat(ctx context.Context, name string) (ObjectInfo, error) {
+	obj, err := m.get("stat", name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Name: name, Size: int64(len(obj.data)), ModTime: obj.modTime}, nil
+}
+
+func (m *Memory) Open(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	obj, err := m.get("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return memoryReader{bytes.NewReader(obj.data)}, nil
+}
+
+func (m *Memory) Put(ctx context.Context, name string, r io.Reader) (int64, error) {
+	if !validName(name) {
+		return 0, &fs.PathError{Op: "put", Path: name, Err: ErrInvalidName}
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[name] = memoryObject{data: data, modTime: time.Now()}
+	m.version++
+	return int64(len(data)), nil
+}
+
+func (m *Memory) Delete(ctx context.Context, name string) error {
+	if !validName(name) {
+		return &fs.PathError{Op: "delete", Path: name, Err: ErrInvalidName}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.objects[name]; !ok {
+		return &fs.PathError{Op: "delete", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.objects, name)
+	m.version++
+	return nil
+}
+
+func (m *Memory) Rename(ctx context.Context, oldName, newName string) error {
+	for _, name := range []string{oldName, newName} {
+		if !validName(name) {
+			return &fs.PathError{Op: "rename", Path: name, Err: ErrInvalidName}
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.objects[oldName]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrNotExist}
+	}
+	delete(m.objects, oldName)
+	m.objects[newName] = obj
+	m.version++
+	return nil
+}
+
+// ProbeWrite always succeeds, memory is always writable.
+func (m *Memory) ProbeWrite(ctx context.Context) error {
+	return nil
+}
+
+// Version counts the changes made to the objects.
+func (m *Memory) Version(ctx context.Context) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return strconv.Itoa(m.version), nil
+}
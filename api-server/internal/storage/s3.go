@@ -0,0 +1,452 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MinPartSize is the smallest part S3 accepts in a multipart upload, except
+// for the last part.
+const MinPartSize = 5 << 20
+
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g. https://s3.eu-central-1.amazonaws.com
+	// or http://minio:9000. Buckets are addressed by path.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to every object name, e.g. "frames/".
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PartSize is the size of the parts of multipart uploads. Objects of at
+	// most PartSize bytes are stored with a single request.
+	PartSize int64
+	// PresignExpiry is how long presigned download URLs are valid. Downloads
+	// are proxied through the server when it is zero.
+	PresignExpiry time.Duration
+}
+
+// S3 stores objects in a bucket of an S3-compatible object store.
+type S3 struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+	signer   signer
+	now      func() time.Time
+}
+
+// NewS3 returns a backend for cfg. A nil client means http.DefaultClient.
+func NewS3(cfg S3Config, client *http.Client) (*S3, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3 endpoint: %w", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3 endpoint: %q is not an http or https URL", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3 bucket must not be empty")
+	}
+	if cfg.PartSize < MinPartSize {
+		return nil, fmt.Errorf("s3 part size must be at least %d, got %d", MinPartSize, cfg.PartSize)
+	}
+	if cfg.PresignExpiry < 0 || cfg.PresignExpiry > maxPresignTime {
+		return nil, fmt.Errorf("s3 presign expiry must be between 0 and %s, got %s", maxPresignTime, cfg.PresignExpiry)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &S3{
+		cfg:      cfg,
+		endpoint: endpoint,
+		client:   client,
+		signer:   signer{accessKeyID: cfg.AccessKeyID, secretAccessKey: cfg.SecretAccessKey, region: cfg.Region},
+		now:      time.Now,
+	}, nil
+}
+
+// s3Error is an error response of the object store.
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return "s3: " + http.StatusText(e.StatusCode)
+	}
+	return fmt.Sprintf("s3: %s: %s", e.Code, e.Message)
+}
+
+func (s *S3) url(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.cfg.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = encodePath(u.Path)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// do sends a signed request and returns the response if its status is 2xx.
+// Other responses are turned into errors wrapped in a *fs.PathError, with
+// fs.ErrNotExist for missing objects.
+func (s *S3) do(ctx context.Context, op, name, method string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	key := ""
+	if name != "" {
+		key = s.cfg.Prefix + name
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.url(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	hash := sha256.Sum256(body)
+	s.signer.sign(req, hex.EncodeToString(hash[:]), s.now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if res.StatusCode/100 == 2 {
+		return res, nil
+	}
+	defer res.Body.Close()
+
+	s3err := &s3Error{StatusCode: res.StatusCode}
+	data, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	_ = xml.Unmarshal(data, s3err)
+	if res.StatusCode == http.StatusNotFound && name != "" && (s3err.Code == "" || s3err.Code == "NoSuchKey") {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return nil, &fs.PathError{Op: op, Path: name, Err: s3err}
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {s.cfg.Prefix + prefix},
+			// Keys below a "/" are not in the flat namespace of frames.
+			"delimiter": {"/"},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		res, err := s.do(ctx, "list", "", http.MethodGet, query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list: %w", err)
+		}
+
+		for _, c := range result.Contents {
+			name := strings.TrimPrefix(c.Key, s.cfg.Prefix)
+			if !validName(name) {
+				continue
+			}
+			objects = append(objects, ObjectInfo{Name: name, Size: c.Size, ModTime: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+	return objects, nil
+}
+
+func (s *S3) Stat(ctx context.Context, name string) (ObjectInfo, error) {
+	if !validName(name) {
+		return ObjectInfo{}, &fs.PathError{Op: "stat", Path: name, Err: ErrInvalidName}
+	}
+	res, err := s.do(ctx, "stat", name, http.MethodHead, nil, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	res.Body.Close()
+
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return ObjectInfo{Name: name, Size: res.ContentLength, ModTime: modTime}, nil
+}
+
+// Open returns a reader that fetches the object lazily, with one ranged GET
+// per seek, so serving a range of a large object does not download all of it.
+func (s *S3) Open(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	info, err := s.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Reader{ctx: ctx, store: s, name: name, size: info.Size}, nil
+}
+
+type s3Reader struct {
+	ctx    context.Context
+	store  *S3
+	name   string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		header := http.Header{}
+		if r.offset > 0 {
+			header.Set("Range", "bytes="+strconv.FormatInt(r.offset, 10)+"-")
+		}
+		res, err := r.store.do(r.ctx, "read", r.name, http.MethodGet, nil, header, nil)
+		if err != nil {
+			return 0, err
+		}
+		r.body = res.Body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: r.name, Err: fs.ErrInvalid}
+	}
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+func contentType(name string) http.Header {
+	header := http.Header{}
+	if ct := mime.TypeByExtension(path.Ext(name)); ct != "" {
+		header.Set("Content-Type", ct)
+	}
+	return header
+}
+
+// Put stores objects smaller than the part size with a single request and
+// larger ones with a multipart upload, so memory use is bounded by the part size.
+func (s *S3) Put(ctx context.Context, name string, r io.Reader) (int64, error) {
+	if !validName(name) {
+		return 0, &fs.PathError{Op: "put", Path: name, Err: ErrInvalidName}
+	}
+	// The buffer grows with the object, so small objects need little memory.
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(io.LimitReader(r, s.cfg.PartSize+1)); err != nil {
+		return 0, err
+	}
+	data := buf.Bytes()
+	if int64(len(data)) <= s.cfg.PartSize {
+		res, err := s.do(ctx, "put", name, http.MethodPut, nil, contentType(name), data)
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return int64(len(data)), nil
+	}
+	// The first part must not grow into the byte read past it.
+	first := data[:s.cfg.PartSize:s.cfg.PartSize]
+	return s.putMultipart(ctx, name, first, io.MultiReader(bytes.NewReader(data[s.cfg.PartSize:]), r))
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []completePart `xml:"Part"`
+}
+
+type completePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// putMultipart uploads first and the rest of r as parts. The upload is
+// aborted on failure so the store does not keep the parts.
+func (s *S3) putMultipart(ctx context.Context, name string, first []byte, r io.Reader) (int64, error) {
+	res, err := s.do(ctx, "put", name, http.MethodPost, url.Values{"uploads": {""}}, contentType(name), nil)
+	if err != nil {
+		return 0, err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(res.Body).Decode(&initiated)
+	res.Body.Close()
+	if err != nil {
+		return 0, fmt.Errorf("s3 create multipart upload: %w", err)
+	}
+	uploadID := initiated.UploadID
+
+	written, complete, err := s.uploadParts(ctx, name, uploadID, first, r)
+	if err == nil {
+		var body []byte
+		body, err = xml.Marshal(complete)
+		if err == nil {
+			res, err = s.do(ctx, "put", name, http.MethodPost, url.Values{"uploadId": {uploadID}}, nil, body)
+		}
+		if err == nil {
+			// Completion can fail after the 200 status has been sent.
+			err = checkBodyError("put", name, res)
+		}
+	}
+	if err != nil {
+		if res, abortErr := s.do(context.WithoutCancel(ctx), "put", name, http.MethodDelete, url.Values{"uploadId": {uploadID}}, nil, nil); abortErr == nil {
+			res.Body.Close()
+		}
+		return 0, err
+	}
+	return written, nil
+}
+
+func (s *S3) uploadParts(ctx context.Context, name, uploadID string, part []byte, r io.Reader) (int64, completeMultipartUpload, error) {
+	var complete completeMultipartUpload
+	var written int64
+	for number := 1; len(part) > 0; number++ {
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		res, err := s.do(ctx, "put", name, http.MethodPut, query, nil, part)
+		if err != nil {
+			return 0, complete, err
+		}
+		res.Body.Close()
+		complete.Parts = append(complete.Parts, completePart{PartNumber: number, ETag: res.Header.Get("ETag")})
+		written += int64(len(part))
+
+		n, err := io.ReadFull(r, part[:cap(part)])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, complete, err
+		}
+		part = part[:n]
+	}
+	return written, complete, nil
+}
+
+// checkBodyError closes res and returns the error in its body, if any. S3
+// reports some failures of copies and multipart completions this way.
+func checkBodyError(op, name string, res *http.Response) error {
+	defer res.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	s3err := &s3Error{StatusCode: res.StatusCode}
+	var root struct{ XMLName xml.Name }
+	if xml.Unmarshal(data, &root) == nil && root.XMLName.Local == "Error" {
+		_ = xml.Unmarshal(data, s3err)
+		return &fs.PathError{Op: op, Path: name, Err: s3err}
+	}
+	return nil
+}
+
+func (s *S3) Delete(ctx context.Context, name string) error {
+	// S3 deletes missing objects without complaint.
+	if _, err := s.Stat(ctx, name); err != nil {
+		return err
+	}
+	res, err := s.do(ctx, "delete", name, http.MethodDelete, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Rename copies the object on the server and deletes the original.
+func (s *S3) Rename(ctx context.Context, oldName, newName string) error {
+	for _, name := range []string{oldName, newName} {
+		if !validName(name) {
+			return &fs.PathError{Op: "rename", Path: name, Err: ErrInvalidName}
+		}
+	}
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", encodePath("/"+s.cfg.Bucket+"/"+s.cfg.Prefix+oldName))
+	res, err := s.do(ctx, "rename", newName, http.MethodPut, nil, header, nil)
+	if err != nil {
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) && errors.Is(err, fs.ErrNotExist) {
+			pathErr.Path = oldName
+		}
+		return err
+	}
+	if err := checkBodyError("rename", newName, res); err != nil {
+		return err
+	}
+
+	res, err = s.do(ctx, "rename", oldName, http.MethodDelete, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// PresignGet returns a URL that downloads the object without credentials
+// until PresignExpiry has passed. It returns errors.ErrUnsupported when
+// presigning is disabled.
+func (s *S3) PresignGet(ctx context.Context, name string) (string, error) {
+	if !validName(name) {
+		return "", &fs.PathError{Op: "presign", Path: name, Err: ErrInvalidName}
+	}
+	if s.cfg.PresignExpiry == 0 {
+		return "", errors.ErrUnsupported
+	}
+	u := s.signer.presign(http.MethodGet, s.url(s.cfg.Prefix+name, nil), s.cfg.PresignExpiry, s.now())
+	return u.String(), nil
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrInvalidName is returned for names that are empty, contain path
+// separators or are "." or "..". Frames live in a flat namespace.
+var ErrInvalidName = errors.New("invalid object name")
+
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Backend stores the frame files. Missing objects are reported with errors
+// wrapping fs.ErrNotExist.
+type Backend interface {
+	// List returns the objects whose names start with prefix, sorted by name.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	Stat(ctx context.Context, name string) (ObjectInfo, error)
+	Open(ctx context.Context, name string) (io.ReadSeekCloser, error)
+	// Put stores the content of r under name, replacing any existing object.
+	// Readers never observe a partially written object.
+	Put(ctx context.Context, name string, r io.Reader) (int64, error)
+	Delete(ctx context.Context, name string) error
+	// Rename moves an object, replacing any object named newName.
+	Rename(ctx context.Context, oldName, newName string) error
+}
+
+// Versioner is implemented by backends that can cheaply tell whether their
+// list of objects changed. The version changes whenever objects are added,
+// removed or renamed.
+type Versioner interface {
+	Version(ctx context.Context) (string, error)
+}
+
+// WriteProber is implemented by backends that can check they accept writes
+// without changing their list of objects.
+type WriteProber interface {
+	ProbeWrite(ctx context.Context) error
+}
+
+// FreeSpacer is implemented by backends with limited capacity.
+type FreeSpacer interface {
+	FreeBytes(ctx context.Context) (uint64, error)
+}
+
+// Presigner is implemented by backends whose objects clients can download
+// directly. PresignGet returns errors.ErrUnsupported if it is disabled.
+type Presigner interface {
+	PresignGet(ctx context.Context, name string) (string, error)
+}
+
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
@@ -0,0 +1,231 @@
+package upload
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"AnimeFrameBot/internal/ratelimit"
+)
+
+var (
+	errUnsupportedType = errors.New("content type must be multipart/form-data, application/zip, application/x-tar or application/gzip")
+	errInvalidBatch    = errors.New("invalid batch")
+)
+
+// forEachFile calls fn with the name and content of every file in the body of
+// r: the file parts of a multipart form, or the regular files of a zip, tar or
+// gzipped tar archive. Directories in archives are dropped from the names.
+// Errors of fn are returned as they are.
+func forEachFile(r *http.Request, fn func(name string, content io.Reader) error) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return errUnsupportedType
+	}
+	switch mediaType {
+	case "multipart/form-data":
+		return forEachPart(r, fn)
+	case "application/zip", "application/x-zip-compressed":
+		return forEachZipFile(r.Body, fn)
+	case "application/x-tar":
+		return forEachTarFile(r.Body, fn)
+	case "application/gzip", "application/x-gzip":
+		return forEachTarGzFile(r.Body, fn)
+	default:
+		return errUnsupportedType
+	}
+}
+
+// archiveType returns the media type of an archive by the extension of its
+// name, or "" if fileName is not an archive.
+func archiveType(fileName string) string {
+	lower := strings.ToLower(fileName)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return "application/zip"
+	case strings.HasSuffix(lower, ".tar"):
+		return "application/x-tar"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "application/gzip"
+	}
+	return ""
+}
+
+// forEachArchiveFile is forEachFile for an archive of the given media type
+// stored in f.
+func forEachArchiveFile(mediaType string, f *os.File, fn func(name string, content io.Reader) error) error {
+	switch mediaType {
+	case "application/zip":
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		return forEachZipEntry(f, info.Size(), fn)
+	case "application/x-tar":
+		return forEachTarFile(f, fn)
+	case "application/gzip":
+		return forEachTarGzFile(f, fn)
+	default:
+		return errUnsupportedType
+	}
+}
+
+// invalidBatch marks errors reading the body as errInvalidBatch, unless the
+// body was too large.
+func invalidBatch(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", errInvalidBatch, err)
+}
+
+func forEachPart(r *http.Request, fn func(name string, content io.Reader) error) error {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return invalidBatch(err)
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return invalidBatch(err)
+		}
+		if part.FileName() == "" {
+			continue
+		}
+		// File names are escaped like for single uploads.
+		name := part.FileName()
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if err := fn(name, part); err != nil {
+			return err
+		}
+	}
+}
+
+// forEachZipFile buffers the archive in a temporary file, as zip archives are
+// read from their end.
+func forEachZipFile(body io.Reader, fn func(name string, content io.Reader) error) error {
+	tmp, err := os.CreateTemp("", "batch-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, body)
+	if err != nil {
+		return invalidBatch(err)
+	}
+
+	return forEachZipEntry(tmp, size, fn)
+}
+
+func forEachZipEntry(r io.ReaderAt, size int64, fn func(name string, content io.Reader) error) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return invalidBatch(err)
+	}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return invalidBatch(err)
+		}
+		err = fn(path.Base(f.Name), rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func forEachTarGzFile(r io.Reader, fn func(name string, content io.Reader) error) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return invalidBatch(err)
+	}
+	defer gz.Close()
+	return forEachTarFile(gz, fn)
+}
+
+func forEachTarFile(r io.Reader, fn func(name string, content io.Reader) error) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return invalidBatch(err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(path.Base(header.Name), tr); err != nil {
+			return err
+		}
+	}
+}
+
+// batch stores the files of a batch and collects the results.
+type batch struct {
+	in           *Ingester
+	hashes       *storedHashes
+	maxBytes     int64
+	response     BatchResponse
+	createdBytes int64
+}
+
+func newBatch(in *Ingester, maxBytes int64) *batch {
+	return &batch{in: in, hashes: in.newStoredHashes(), maxBytes: maxBytes, response: BatchResponse{Results: []Result{}}}
+}
+
+// add stores one file of at most maxBytes. Read errors are errInvalidBatch.
+func (b *batch) add(ctx context.Context, name string, content io.Reader) error {
+	data, err := io.ReadAll(io.LimitReader(content, b.maxBytes+1))
+	if err != nil {
+		return invalidBatch(err)
+	}
+	result := rejected(name, reasonTooLarge)
+	switch {
+	case int64(len(data)) > b.maxBytes:
+	case !ratelimit.WithinQuota(ctx, b.response.Created+1, b.createdBytes+int64(len(data))):
+		// Files stop being stored once they would take the client over its
+		// daily quota.
+		result = rejected(name, reasonQuota)
+	default:
+		result, err = b.in.ingest(ctx, b.hashes, name, data, nil, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch result.Status {
+	case StatusCreated:
+		b.response.Created++
+		b.createdBytes += result.Size
+	case StatusDuplicate:
+		b.response.Duplicates++
+	case StatusRejected:
+		b.response.Rejected++
+	}
+	b.response.Results = append(b.response.Results, result)
+	return nil
+}
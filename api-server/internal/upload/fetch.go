@@ -0,0 +1,162 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxRedirects bounds the redirects followed when fetching an image.
+const maxRedirects = 5
+
+var (
+	errInvalidURL     = errors.New("url must be an absolute http or https URL")
+	errBlockedAddress = errors.New("address is not public")
+)
+
+// imageExtensions maps the accepted content types to file extensions.
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// sharedAddresses is the carrier-grade NAT range, which net/netip does not
+// count as private.
+var sharedAddresses = netip.MustParsePrefix("100.64.0.0/10")
+
+// publicAddr reports whether addr is a public unicast address.
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddresses.Contains(addr)
+}
+
+// blockPrivate is a net.Dialer control function refusing connections to
+// addresses that are not public. It runs after name resolution, so it also
+// covers redirects and host names resolving to internal addresses.
+func blockPrivate(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !publicAddr(addr) {
+		return fmt.Errorf("%s: %w", host, errBlockedAddress)
+	}
+	return nil
+}
+
+// Fetcher downloads images to import, with limits on their size, the time
+// taken and their content type.
+type Fetcher struct {
+	client   *http.Client
+	maxBytes int64
+}
+
+// NewFetcher returns a Fetcher for images of at most maxBytes that are fetched
+// within timeout. Unless allowPrivate is set, only public addresses are
+// contacted. Proxies from the environment are not used, as they would hide
+// the address.
+func NewFetcher(timeout time.Duration, maxBytes int64, allowPrivate bool) *Fetcher {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = blockPrivate
+	}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       time.Minute,
+	}
+	return &Fetcher{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= maxRedirects {
+					return fmt.Errorf("stopped after %d redirects", maxRedirects)
+				}
+				if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+					return errInvalidURL
+				}
+				return nil
+			},
+		},
+		maxBytes: maxBytes,
+	}
+}
+
+// fetchError is a failure of the source of an import.
+type fetchError struct {
+	err error
+}
+
+func (e *fetchError) Error() string { return "fetch image: " + e.err.Error() }
+func (e *fetchError) Unwrap() error { return e.err }
+
+// Fetch downloads the image at rawURL. It returns its content and the file
+// extension for its content type.
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) ([]byte, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, "", errInvalidURL
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", errInvalidURL
+	}
+	req.Header.Set("Accept", "image/jpeg, image/png, image/gif")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, "", &fetchError{err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &fetchError{fmt.Errorf("source responded %s", resp.Status)}
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	ext, ok := imageExtensions[mediaType]
+	if !ok {
+		return nil, "", &fetchError{fmt.Errorf("content type %q is not an image", resp.Header.Get("Content-Type"))}
+	}
+	if resp.ContentLength > f.maxBytes {
+		return nil, "", &fetchError{errors.New(reasonTooLarge)}
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, f.maxBytes+1))
+	if err != nil {
+		return nil, "", &fetchError{err}
+	}
+	if int64(len(content)) > f.maxBytes {
+		return nil, "", &fetchError{errors.New(reasonTooLarge)}
+	}
+	return content, ext, nil
+}
+
+// subtitleFromURL is the last path element of u without its extension.
+func subtitleFromURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return ""
+	}
+	return strings.TrimSuffix(name, path.Ext(name))
+}
@@ -1,21 +1,30 @@
 package upload
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
-	"os"
-	"path/filepath"
-	"strings"
+	"strconv"
+
+	"AnimeFrameBot/internal/auth"
+	"AnimeFrameBot/internal/metrics"
+	"AnimeFrameBot/internal/ratelimit"
+)
+
+var (
+	uploadBytes      = metrics.NewCounter("upload_bytes_total", "Bytes of uploaded images stored.")
+	uploadDuplicates = metrics.NewCounter("upload_duplicates_total", "Uploads whose content was already stored.")
 )
 
-func HandleUpload(imageDir string) http.HandlerFunc {
+// HandleUpload stores an uploaded image with in.
+func HandleUpload(in *Ingester, maxBytes int64) http.HandlerFunc {
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
-			r.Body = http.MaxBytesReader(w, r.Body, 10<<20)
-			if err := r.ParseMultipartForm(10 << 20); err != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+			if err := r.ParseMultipartForm(maxBytes); err != nil {
 				http.Error(w, "Request too large", http.StatusBadRequest)
 				return
 			}
@@ -27,51 +36,392 @@ func HandleUpload(imageDir string) http.HandlerFunc {
 			}
 			defer file.Close()
 
-			if !isImage(file) {
-				http.Error(w, "File is not an image", http.StatusBadRequest)
+			fileBytes, err := io.ReadAll(file)
+			if err != nil {
+				http.Error(w, "Error reading file", http.StatusInternalServerError)
 				return
 			}
 
-			if _, err := file.Seek(0, io.SeekStart); err != nil {
-				http.Error(w, "Error resetting file cursor", http.StatusInternalServerError)
+			fileName, err := url.QueryUnescape(handler.Filename)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
 
-			fileBytes, err := io.ReadAll(file)
+			result, err := in.ingest(r.Context(), nil, fileName, fileBytes, nil, false)
 			if err != nil {
-				http.Error(w, "Error reading file", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "store upload", "file", fileName, "error", err)
+				http.Error(w, "Error storing file", http.StatusInternalServerError)
+				return
+			}
+			if result.Status == StatusRejected {
+				http.Error(w, result.Reason, http.StatusBadRequest)
 				return
 			}
+			w.WriteHeader(http.StatusCreated)
+		})
+}
+
+// BatchResponse reports the outcome of a batch upload per file.
+type BatchResponse struct {
+	Created    int      `json:"created"`
+	Duplicates int      `json:"duplicates"`
+	Rejected   int      `json:"rejected"`
+	Results    []Result `json:"results"`
+	// Error tells why the request body could not be read to its end. The
+	// files before that were handled and are reported.
+	Error string `json:"error,omitempty"`
+}
 
-			hash := sha256.Sum256(fileBytes)
-			hashString := hex.EncodeToString(hash[:])
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(bytes)
+}
 
-			fileName, err := url.QueryUnescape(handler.Filename)
+// HandleBatch stores every image of a multipart form or a zip or tar archive
+// the same way as HandleUpload, and reports the result of each file. Created
+// files are charged against the upload quota one by one.
+func HandleBatch(in *Ingester, maxBytes, maxBatchBytes int64) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBatchBytes)
+			b := newBatch(in, maxBytes)
+			err := forEachFile(r, func(name string, content io.Reader) error {
+				return b.add(r.Context(), name, content)
+			})
+			writeBatch(w, r, b, err)
+		})
+}
+
+// writeBatch charges the created files of b against the upload quota and
+// reports them, or the error that stopped the batch.
+func writeBatch(w http.ResponseWriter, r *http.Request, b *batch, err error) {
+	ratelimit.ChargeUploads(r.Context(), b.response.Created, b.createdBytes)
+
+	response := b.response
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errUnsupportedType):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	case errors.As(err, &maxBytesErr):
+		response.Error = "Request too large"
+		writeJSON(w, http.StatusRequestEntityTooLarge, response)
+		return
+	case errors.Is(err, errInvalidBatch):
+		response.Error = err.Error()
+		writeJSON(w, http.StatusBadRequest, response)
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "store batch upload", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "stored batch upload",
+		"created", response.Created, "duplicates", response.Duplicates, "rejected", response.Rejected)
+	writeJSON(w, http.StatusOK, response)
+}
+
+// maxImportRequestBytes bounds the JSON body of an import request.
+const maxImportRequestBytes = 64 << 10
+
+type importRequest struct {
+	URL      string `json:"url"`
+	Subtitle string `json:"subtitle"`
+}
+
+// HandleImport fetches the image at a URL and stores it the same way as
+// HandleUpload. Without a subtitle, the file name in the URL is used.
+func HandleImport(in *Ingester, fetcher *Fetcher) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, maxImportRequestBytes)
+			var req importRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+			if req.URL == "" {
+				http.Error(w, "url is required", http.StatusBadRequest)
+				return
+			}
+			subtitle := req.Subtitle
+			if subtitle == "" {
+				subtitle = subtitleFromURL(req.URL)
+			}
+			if subtitle == "" {
+				http.Error(w, "subtitle is required", http.StatusBadRequest)
+				return
+			}
+
+			content, ext, err := fetcher.Fetch(r.Context(), req.URL)
+			var fetchErr *fetchError
+			switch {
+			case errors.Is(err, errInvalidURL), errors.Is(err, errBlockedAddress):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			case errors.As(err, &fetchErr):
+				slog.InfoContext(r.Context(), "fetch import", "url", req.URL, "error", err)
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			case err != nil:
+				slog.ErrorContext(r.Context(), "fetch import", "url", req.URL, "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			fileName := subtitle + ext
+			result, err := in.ingest(r.Context(), nil, fileName, content, map[string]string{"source_url": req.URL}, true)
 			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
+				slog.ErrorContext(r.Context(), "store import", "file", fileName, "error", err)
+				http.Error(w, "Error storing file", http.StatusInternalServerError)
+				return
+			}
+			if result.Status == StatusRejected {
+				http.Error(w, result.Reason, http.StatusBadRequest)
 				return
 			}
-			ext := filepath.Ext(fileName)
-			baseName := strings.TrimSuffix(fileName, ext)
-			newFileName := baseName + "_" + hashString + ext
+			if result.Status == StatusDuplicate {
+				// Nothing was stored, the result names the existing frame.
+				ratelimit.ChargeUploads(r.Context(), 0, 0)
+				writeJSON(w, http.StatusOK, result)
+				return
+			}
+			ratelimit.ChargeUploads(r.Context(), 1, result.Size)
+			writeJSON(w, http.StatusCreated, result)
+		})
+}
+
+// owner is the name of the API key of r, or "" without authentication.
+func owner(r *http.Request) string {
+	if key, ok := auth.FromContext(r.Context()); ok {
+		return key.Name
+	}
+	return ""
+}
+
+func setUploadHeaders(w http.ResponseWriter, u stagedUpload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Upload-Expires", u.ExpiresAt.Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// lookupUpload returns the upload named in the path of r, or writes the error.
+func lookupUpload(w http.ResponseWriter, r *http.Request, res *Resumable) (stagedUpload, bool) {
+	u, err := res.get(r.PathValue("id"), owner(r))
+	if errors.Is(err, errUploadNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return u, false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "read staged upload", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return u, false
+	}
+	return u, true
+}
+
+// HandleResumableCreate starts a resumable upload of Upload-Length bytes. The
+// Upload-Metadata header names the file; archives may be as large as a batch.
+func HandleResumableCreate(res *Resumable, maxBytes, maxBatchBytes int64) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// Creating an upload stores nothing yet.
+			ratelimit.ChargeUploads(r.Context(), 0, 0)
 
-			dst, err := os.Create(filepath.Join(imageDir, newFileName))
+			length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+			if err != nil || length <= 0 {
+				http.Error(w, "Upload-Length must be a positive number", http.StatusBadRequest)
+				return
+			}
+			metadata, err := parseMetadata(r.Header.Get("Upload-Metadata"))
 			if err != nil {
-				http.Error(w, "Error creating file", http.StatusInternalServerError)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fileName := metadata["filename"]
+			if fileName == "" {
+				http.Error(w, "Upload-Metadata needs a filename", http.StatusBadRequest)
 				return
 			}
-			defer dst.Close()
+			limit := maxBytes
+			if archiveType(fileName) != "" {
+				limit = maxBatchBytes
+			}
+			if length > limit {
+				http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			// Staged uploads count against the daily quota before they
+			// are finalized, so that they cannot fill the disk.
+			fits := func(staged int64) bool { return ratelimit.WithinQuota(r.Context(), 0, staged) }
+			u, err := res.create(fileName, length, owner(r), fits)
+			if errors.Is(err, errStagingQuota) {
+				http.Error(w, reasonQuota, http.StatusTooManyRequests)
+				return
+			}
+			if err != nil {
+				slog.ErrorContext(r.Context(), "create staged upload", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			slog.InfoContext(r.Context(), "created resumable upload", "id", u.ID, "file", fileName, "length", length)
+			setUploadHeaders(w, u)
+			w.Header().Set("Location", "/frame/uploads/"+u.ID)
+			w.WriteHeader(http.StatusCreated)
+		})
+}
+
+// HandleResumableStatus reports the offset of an upload, where the next chunk
+// starts.
+func HandleResumableStatus(res *Resumable) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			u, ok := lookupUpload(w, r, res)
+			if !ok {
+				return
+			}
+			setUploadHeaders(w, u)
+			w.WriteHeader(http.StatusOK)
+		})
+}
+
+// HandleResumableChunk appends the request body to an upload at the offset in
+// the Upload-Offset header.
+func HandleResumableChunk(res *Resumable) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+				http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+				return
+			}
+			offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+			if err != nil || offset < 0 {
+				http.Error(w, "Upload-Offset must be a number", http.StatusBadRequest)
+				return
+			}
+			// The upload is read after acquiring it, so its offset is current.
+			id := r.PathValue("id")
+			if err := res.acquire(id); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			defer res.release(id)
+			u, ok := lookupUpload(w, r, res)
+			if !ok {
+				return
+			}
+
+			u.Offset, err = res.appendChunk(u, offset, r.Body)
+			setUploadHeaders(w, u)
+			switch {
+			case errors.Is(err, errOffsetMismatch):
+				http.Error(w, err.Error(), http.StatusConflict)
+			case errors.Is(err, errChunkTooLarge):
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			case err != nil:
+				// Most likely the connection broke. The bytes received are kept.
+				slog.InfoContext(r.Context(), "append chunk", "id", u.ID, "offset", u.Offset, "error", err)
+				http.Error(w, "Upload interrupted", http.StatusBadRequest)
+			default:
+				w.WriteHeader(http.StatusNoContent)
+			}
+		})
+}
 
-			if _, err := file.Seek(0, io.SeekStart); err != nil {
-				http.Error(w, "Error resetting file cursor", http.StatusInternalServerError)
+// HandleResumableCancel removes an upload.
+func HandleResumableCancel(res *Resumable) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			id := r.PathValue("id")
+			if err := res.acquire(id); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
 				return
 			}
+			defer res.release(id)
+			u, ok := lookupUpload(w, r, res)
+			if !ok {
+				return
+			}
+			res.remove(u.ID)
+			w.WriteHeader(http.StatusNoContent)
+		})
+}
 
-			if _, err := io.Copy(dst, file); err != nil {
+// HandleResumableFinalize stores a complete upload the same way as
+// HandleUpload, or, for a zip or tar archive, as HandleBatch. The staged data
+// is removed unless storing failed on the server's side.
+func HandleResumableFinalize(res *Resumable, in *Ingester, maxBytes int64) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			id := r.PathValue("id")
+			if err := res.acquire(id); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			defer res.release(id)
+			u, ok := lookupUpload(w, r, res)
+			if !ok {
+				return
+			}
+
+			f, err := res.open(u)
+			if errors.Is(err, errUploadIncomplete) {
+				setUploadHeaders(w, u)
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				slog.ErrorContext(r.Context(), "open staged upload", "id", u.ID, "error", err)
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
+			defer f.Close()
 
-			w.WriteHeader(http.StatusCreated)
+			if mediaType := archiveType(u.FileName); mediaType != "" {
+				b := newBatch(in, maxBytes)
+				err := forEachArchiveFile(mediaType, f, func(name string, content io.Reader) error {
+					return b.add(r.Context(), name, content)
+				})
+				if err == nil || errors.Is(err, errInvalidBatch) {
+					res.remove(u.ID)
+				}
+				writeBatch(w, r, b, err)
+				return
+			}
+
+			content, err := io.ReadAll(f)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "read staged upload", "id", u.ID, "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			result, err := in.ingest(r.Context(), nil, u.FileName, content, nil, true)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "store upload", "file", u.FileName, "error", err)
+				http.Error(w, "Error storing file", http.StatusInternalServerError)
+				return
+			}
+			res.remove(u.ID)
+			if result.Status == StatusRejected {
+				ratelimit.ChargeUploads(r.Context(), 0, 0)
+				http.Error(w, result.Reason, http.StatusBadRequest)
+				return
+			}
+			if result.Status == StatusDuplicate {
+				ratelimit.ChargeUploads(r.Context(), 0, 0)
+				writeJSON(w, http.StatusOK, result)
+				return
+			}
+			ratelimit.ChargeUploads(r.Context(), 1, result.Size)
+			writeJSON(w, http.StatusCreated, result)
 		})
 }
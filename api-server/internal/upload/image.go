@@ -0,0 +1,168 @@
+package upload
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // registers the GIF decoder
+	"image/jpeg"
+	"image/png"
+	"sort"
+)
+
+const reasonImageTooLarge = "Image dimensions too large"
+
+// jpegQuality is used when re-encoding JPEG images.
+const jpegQuality = 90
+
+// Images limits the images accepted for upload. Every image is decoded in
+// full; the dimensions are checked before, so that small files that decode to
+// huge images are refused without allocating them.
+//
+// Metadata, which may tell where and with what device a picture was taken, is
+// removed from JPEG and PNG images without touching the image data. Images
+// with an EXIF orientation are turned as it says and encoded again instead,
+// and so are GIFs, as frames are stored as JPEG or PNG.
+type Images struct {
+	MaxPixels int64
+	MaxSide   int
+	// Reencode stores images decoded and encoded again: JPEG as JPEG, PNG and
+	// GIF as PNG. It drops anything besides the pixels, like trailing data.
+	Reencode bool
+}
+
+// imageExtensionsByFormat maps decoded formats to the extension of stored
+// files.
+var imageExtensionsByFormat = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"gif":  ".png",
+}
+
+// checkedImage is an accepted image as it is to be stored.
+type checkedImage struct {
+	content []byte
+	// ext is the extension of the stored format.
+	ext           string
+	format        string
+	width, height int
+	colors        []string
+}
+
+// check decodes content and returns the image to store, or a reason to reject
+// it.
+func (im Images) check(content []byte) (checkedImage, string) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return checkedImage{}, reasonNotImage
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return checkedImage{}, reasonNotImage
+	}
+	if config.Width > im.MaxSide || config.Height > im.MaxSide ||
+		int64(config.Width)*int64(config.Height) > im.MaxPixels {
+		return checkedImage{}, fmt.Sprintf("%s: %dx%d", reasonImageTooLarge, config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return checkedImage{}, reasonNotImage
+	}
+
+	var exif []byte
+	switch format {
+	case "jpeg":
+		content, exif, err = stripJPEG(content)
+	case "png":
+		content, exif, err = stripPNG(content)
+	}
+	if err != nil {
+		return checkedImage{}, reasonNotImage
+	}
+	orientation := exifOrientation(exif)
+	if !im.Reencode && orientation == 1 && format != "gif" {
+		return describe(content, imageExtensionsByFormat[format], format, img), ""
+	}
+
+	img = orient(img, orientation)
+	var b bytes.Buffer
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&b, img, &jpeg.Options{Quality: jpegQuality})
+	default:
+		format = "png"
+		err = png.Encode(&b, img)
+	}
+	if err != nil {
+		return checkedImage{}, reasonNotImage
+	}
+	return describe(b.Bytes(), imageExtensionsByFormat[format], format, img), ""
+}
+
+func describe(content []byte, ext, format string, img image.Image) checkedImage {
+	return checkedImage{
+		content: content,
+		ext:     ext,
+		format:  format,
+		width:   img.Bounds().Dx(),
+		height:  img.Bounds().Dy(),
+		colors:  dominantColors(img),
+	}
+}
+
+const (
+	// paletteSize is the number of dominant colors recorded per image.
+	paletteSize = 5
+	// paletteSamples is the number of pixels sampled along each side.
+	paletteSamples = 64
+)
+
+// dominantColors returns the most common colors of img as "#rrggbb", most
+// common first. Colors are counted in coarse buckets, so that shades of the
+// same color count together, and reported as the average of their bucket.
+// Mostly transparent pixels are not counted.
+func dominantColors(img image.Image) []string {
+	type bucket struct {
+		key           int
+		r, g, b, size int
+	}
+	buckets := map[int]*bucket{}
+	bounds := img.Bounds()
+	stepX := max(1, bounds.Dx()/paletteSamples)
+	stepY := max(1, bounds.Dy()/paletteSamples)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += stepY {
+		for x := bounds.Min.X; x < bounds.Max.X; x += stepX {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A < 128 {
+				continue
+			}
+			key := int(c.R>>5)<<6 | int(c.G>>5)<<3 | int(c.B>>5)
+			bk := buckets[key]
+			if bk == nil {
+				bk = &bucket{key: key}
+				buckets[key] = bk
+			}
+			bk.r += int(c.R)
+			bk.g += int(c.G)
+			bk.b += int(c.B)
+			bk.size++
+		}
+	}
+
+	sorted := make([]*bucket, 0, len(buckets))
+	for _, bk := range buckets {
+		sorted = append(sorted, bk)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].size != sorted[j].size {
+			return sorted[i].size > sorted[j].size
+		}
+		return sorted[i].key < sorted[j].key
+	})
+	colors := []string{}
+	for _, bk := range sorted[:min(paletteSize, len(sorted))] {
+		colors = append(colors, fmt.Sprintf("#%02x%02x%02x", bk.r/bk.size, bk.g/bk.size, bk.b/bk.size))
+	}
+	return colors
+}
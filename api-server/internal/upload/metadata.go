@@ -0,0 +1,190 @@
+package upload
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+)
+
+var errMalformed = errors.New("malformed image")
+
+// JPEG markers.
+const (
+	markerSOS  = 0xDA // start of scan, followed by the image data
+	markerAPP1 = 0xE1 // EXIF and XMP
+	markerAPPD = 0xED // Photoshop and IPTC
+	markerAPPE = 0xEE // Adobe, describes the color transform
+	markerAPPF = 0xEF
+	markerCOM  = 0xFE // comment
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// stripJPEG returns content without the application segments that hold
+// metadata, like EXIF, XMP, ICC profiles and IPTC, and without comments. It
+// also returns the EXIF data, starting at its TIFF header, or nil. The image
+// data is copied as it is.
+func stripJPEG(content []byte) ([]byte, []byte, error) {
+	if len(content) < 2 || content[0] != 0xFF || content[1] != 0xD8 {
+		return nil, nil, errMalformed
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(content)))
+	out.Write(content[:2])
+	var exif []byte
+	i := 2
+	for {
+		if i+4 > len(content) || content[i] != 0xFF {
+			return nil, nil, errMalformed
+		}
+		marker := content[i+1]
+		if marker == 0xFF {
+			// Fill byte before a marker.
+			i++
+			continue
+		}
+		if marker == markerSOS {
+			out.Write(content[i:])
+			return out.Bytes(), exif, nil
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(content[i+2:]))
+		if end > len(content) || end < i+4 {
+			return nil, nil, errMalformed
+		}
+		segment := content[i:end]
+		payload := segment[4:]
+		switch {
+		case marker == markerAPP1 && bytes.HasPrefix(payload, exifHeader):
+			if exif == nil {
+				exif = payload[len(exifHeader):]
+			}
+		case marker >= markerAPP1 && marker <= markerAPPD, marker == markerAPPF, marker == markerCOM:
+		default:
+			out.Write(segment)
+		}
+		i = end
+	}
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadataChunks are the PNG chunks dropped by stripPNG. XMP is stored in
+// iTXt chunks.
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"iCCP": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// stripPNG returns content without the chunks that hold metadata and without
+// anything after the image end. It also returns the EXIF data or nil.
+func stripPNG(content []byte) ([]byte, []byte, error) {
+	if !bytes.HasPrefix(content, pngSignature) {
+		return nil, nil, errMalformed
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(content)))
+	out.Write(pngSignature)
+	var exif []byte
+	for i := len(pngSignature); ; {
+		if i+12 > len(content) {
+			return nil, nil, errMalformed
+		}
+		length := binary.BigEndian.Uint32(content[i:])
+		if uint64(length) > uint64(len(content)-i-12) {
+			return nil, nil, errMalformed
+		}
+		end := i + 12 + int(length)
+		chunk := content[i:end]
+		chunkType := string(chunk[4:8])
+		if chunkType == "eXIf" && exif == nil {
+			// Some writers keep the JPEG header in the chunk.
+			exif = bytes.TrimPrefix(chunk[8:8+length], exifHeader)
+		}
+		if !pngMetadataChunks[chunkType] {
+			out.Write(chunk)
+		}
+		if chunkType == "IEND" {
+			return out.Bytes(), exif, nil
+		}
+		i = end
+	}
+}
+
+// exifOrientation returns the orientation tag of EXIF data, from 1 to 8, or 1
+// if there is none.
+func exifOrientation(exif []byte) int {
+	if len(exif) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(exif[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := order.Uint32(exif[4:])
+	if uint64(ifd)+2 > uint64(len(exif)) {
+		return 1
+	}
+	entries := int(order.Uint16(exif[ifd:]))
+	for n := 0; n < entries; n++ {
+		entry := int(ifd) + 2 + n*12
+		if entry+12 > len(exif) {
+			return 1
+		}
+		if order.Uint16(exif[entry:]) != 0x0112 {
+			continue
+		}
+		orientation := int(order.Uint16(exif[entry+8:]))
+		if orientation < 1 || orientation > 8 {
+			return 1
+		}
+		return orientation
+	}
+	return 1
+}
+
+// orient returns img turned and flipped as its EXIF orientation says, so that
+// it displays correctly without it.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// Orientations 5 to 8 swap the width and the height.
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // rotated by 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // flipped
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // to be rotated clockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // to be rotated counterclockwise
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
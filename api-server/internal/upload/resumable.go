@@ -0,0 +1,314 @@
+package upload
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errUploadNotFound   = errors.New("upload not found")
+	errUploadBusy       = errors.New("upload is in use by another request")
+	errOffsetMismatch   = errors.New("Upload-Offset does not match the received bytes")
+	errChunkTooLarge    = errors.New("chunk exceeds Upload-Length")
+	errUploadIncomplete = errors.New("upload is incomplete")
+	errStagingQuota     = errors.New("staged uploads exceed the upload quota")
+)
+
+// stagedUpload describes a resumable upload. Its data is kept in a file next
+// to the description; the size of that file is the offset.
+type stagedUpload struct {
+	ID       string `json:"id"`
+	FileName string `json:"file_name"`
+	Length   int64  `json:"length"`
+	// Owner is the API key that created the upload; only it may continue.
+	Owner     string    `json:"owner,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Offset    int64     `json:"-"`
+}
+
+// Resumable stages uploads that are sent in chunks on the local disk until
+// they are finalized. Uploads not finished within the expiry, counted from
+// their last chunk, are removed.
+type Resumable struct {
+	dir    string
+	expiry time.Duration
+	now    func() time.Time
+
+	mu   sync.Mutex
+	busy map[string]bool
+	// creating serializes create, so that uploads started together cannot
+	// stage more than the quota allows.
+	creating sync.Mutex
+}
+
+// NewResumable returns a Resumable staging uploads in dir, which is created
+// when needed.
+func NewResumable(dir string, expiry time.Duration) *Resumable {
+	return &Resumable{dir: dir, expiry: expiry, now: time.Now, busy: map[string]bool{}}
+}
+
+func (s *Resumable) infoPath(id string) string { return filepath.Join(s.dir, id+".json") }
+func (s *Resumable) dataPath(id string) string { return filepath.Join(s.dir, id+".data") }
+
+// validID reports whether id has the form of the IDs made by create, so it
+// can be used in paths.
+func validID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return err == nil && len(id) == 32
+}
+
+func (s *Resumable) writeInfo(u stagedUpload) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmp := s.infoPath(u.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.infoPath(u.ID))
+}
+
+// create starts an upload of length bytes. With fits, it fails with
+// errStagingQuota unless fits reports that the bytes owner has staged, this
+// upload included, may be stored.
+func (s *Resumable) create(fileName string, length int64, owner string, fits func(staged int64) bool) (stagedUpload, error) {
+	s.creating.Lock()
+	defer s.creating.Unlock()
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return stagedUpload{}, err
+	}
+	s.sweep()
+	if fits != nil && !fits(s.staged(owner)+length) {
+		return stagedUpload{}, errStagingQuota
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return stagedUpload{}, err
+	}
+	u := stagedUpload{
+		ID:        hex.EncodeToString(id),
+		FileName:  fileName,
+		Length:    length,
+		Owner:     owner,
+		ExpiresAt: s.now().Add(s.expiry).UTC(),
+	}
+	if err := os.WriteFile(s.dataPath(u.ID), nil, 0o600); err != nil {
+		return stagedUpload{}, err
+	}
+	return u, s.writeInfo(u)
+}
+
+// get returns the upload with the given ID if owner may use it.
+func (s *Resumable) get(id, owner string) (stagedUpload, error) {
+	if !validID(id) {
+		return stagedUpload{}, errUploadNotFound
+	}
+	data, err := os.ReadFile(s.infoPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return stagedUpload{}, errUploadNotFound
+	}
+	if err != nil {
+		return stagedUpload{}, err
+	}
+	var u stagedUpload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return stagedUpload{}, err
+	}
+	if u.Owner != owner {
+		return stagedUpload{}, errUploadNotFound
+	}
+	if s.now().After(u.ExpiresAt) {
+		s.remove(id)
+		return stagedUpload{}, errUploadNotFound
+	}
+	info, err := os.Stat(s.dataPath(id))
+	if err != nil {
+		return stagedUpload{}, err
+	}
+	u.Offset = info.Size()
+	return u, nil
+}
+
+// acquire marks an upload as in use, so chunks are not appended concurrently
+// or while it is finalized.
+func (s *Resumable) acquire(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.busy[id] {
+		return errUploadBusy
+	}
+	s.busy[id] = true
+	return nil
+}
+
+func (s *Resumable) release(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.busy, id)
+}
+
+// appendChunk appends the chunk read from r at offset and returns the new
+// offset. The bytes received before a read error are kept, so the client can
+// resume after them.
+func (s *Resumable) appendChunk(u stagedUpload, offset int64, r io.Reader) (int64, error) {
+	if offset != u.Offset {
+		return u.Offset, errOffsetMismatch
+	}
+	f, err := os.OpenFile(s.dataPath(u.ID), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return u.Offset, err
+	}
+	remaining := u.Length - u.Offset
+	written, copyErr := io.Copy(f, io.LimitReader(r, remaining+1))
+	if written > remaining {
+		written = remaining
+		copyErr = errChunkTooLarge
+		if err := f.Truncate(u.Length); err != nil {
+			copyErr = err
+		}
+	}
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+
+	u.Offset += written
+	u.ExpiresAt = s.now().Add(s.expiry).UTC()
+	if err := s.writeInfo(u); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	return u.Offset, copyErr
+}
+
+// open returns the data of a complete upload.
+func (s *Resumable) open(u stagedUpload) (*os.File, error) {
+	if u.Offset != u.Length {
+		return nil, errUploadIncomplete
+	}
+	return os.Open(s.dataPath(u.ID))
+}
+
+func (s *Resumable) remove(id string) {
+	for _, path := range []string{s.dataPath(id), s.infoPath(id)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("remove staged upload", "file", path, "error", err)
+		}
+	}
+}
+
+// staged returns the length of all uploads of owner.
+func (s *Resumable) staged(owner string) int64 {
+	var total int64
+	s.forEachInfo(func(u stagedUpload) {
+		if u.Owner == owner {
+			total += u.Length
+		}
+	})
+	return total
+}
+
+// forEachInfo calls fn with the description of every staged upload.
+func (s *Resumable) forEachInfo(fn func(u stagedUpload)) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		// Nothing was staged yet if the directory is missing.
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("list staged uploads", "error", err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !validID(id) {
+			continue
+		}
+		data, err := os.ReadFile(s.infoPath(id))
+		if err != nil {
+			continue
+		}
+		var u stagedUpload
+		if err := json.Unmarshal(data, &u); err != nil {
+			continue
+		}
+		fn(u)
+	}
+}
+
+// Run removes expired uploads every interval until ctx is done.
+func (s *Resumable) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sweep()
+		}
+	}
+}
+
+// sweep removes expired uploads.
+func (s *Resumable) sweep() {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		// Nothing was staged yet if the directory is missing.
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("list staged uploads", "error", err)
+		}
+		return
+	}
+	now := s.now()
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !validID(id) {
+			continue
+		}
+		data, err := os.ReadFile(s.infoPath(id))
+		if err != nil {
+			continue
+		}
+		var u stagedUpload
+		if err := json.Unmarshal(data, &u); err != nil || now.After(u.ExpiresAt) {
+			s.mu.Lock()
+			busy := s.busy[id]
+			s.mu.Unlock()
+			if !busy {
+				slog.Info("remove expired upload", "id", id)
+				s.remove(id)
+			}
+		}
+	}
+}
+
+// parseMetadata parses an Upload-Metadata header: comma separated pairs of a
+// key and a base64 encoded value.
+func parseMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("Upload-Metadata %s: %w", key, err)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
@@ -1,10 +1,57 @@
 package upload
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"io"
+	"log/slog"
+	"maps"
 	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"AnimeFrameBot/internal/auth"
+	"AnimeFrameBot/internal/catalog"
+	"AnimeFrameBot/internal/storage"
+)
+
+type Status string
+
+const (
+	StatusCreated   Status = "created"
+	StatusDuplicate Status = "duplicate"
+	StatusRejected  Status = "rejected"
+)
+
+// Reasons for rejecting a file.
+const (
+	reasonNotImage    = "File is not an image"
+	reasonInvalidName = "Invalid file name"
+	reasonTooLarge    = "File too large"
+	reasonQuota       = "Upload quota exceeded"
 )
 
+// Result is the outcome of storing one uploaded file.
+type Result struct {
+	// File is the name the file was uploaded with.
+	File string `json:"file"`
+	// Name is the name of the stored frame, or of the frame with the same
+	// content for duplicates.
+	Name   string `json:"name,omitempty"`
+	Status Status `json:"status"`
+	Reason string `json:"reason,omitempty"`
+	// Size is the number of bytes stored.
+	Size int64 `json:"-"`
+}
+
+func rejected(fileName, reason string) Result {
+	return Result{File: fileName, Status: StatusRejected, Reason: reason}
+}
+
 func isImage(file io.Reader) bool {
 	buffer := make([]byte, 512)
 	if _, err := file.Read(buffer); err != nil {
@@ -18,3 +65,174 @@ func isImage(file io.Reader) bool {
 	}
 	return false
 }
+
+// frameHash returns the content hash in a frame name, which ends in
+// "_<hash>.<ext>", or "" if there is none.
+func frameHash(name string) string {
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	i := strings.LastIndex(base, "_")
+	if i < 0 || base == name {
+		return ""
+	}
+	return base[i+1:]
+}
+
+// storedHashes finds stored frames by content hash. With a catalog it looks
+// them up there. Without one it lists the store on the first lookup and
+// remembers the frames stored since, so a batch lists the store once rather
+// than once per file.
+type storedHashes struct {
+	in *Ingester
+	// names maps hashes to frame names, nil until the store is listed.
+	names map[string]string
+}
+
+func (in *Ingester) newStoredHashes() *storedHashes {
+	return &storedHashes{in: in}
+}
+
+// find returns the name of a stored frame with the given content hash, or ""
+// if there is none.
+func (h *storedHashes) find(ctx context.Context, hash string) (string, error) {
+	if h.in.cat != nil {
+		f, err := h.in.cat.ByHash(hash)
+		if errors.Is(err, catalog.ErrNotFound) {
+			return "", nil
+		}
+		return f.Name, err
+	}
+	if h.names == nil {
+		objects, err := h.in.store.List(ctx, "")
+		if err != nil {
+			return "", err
+		}
+		h.names = make(map[string]string, len(objects))
+		for _, obj := range objects {
+			if hash := frameHash(obj.Name); hash != "" {
+				h.names[hash] = obj.Name
+			}
+		}
+	}
+	return h.names[hash], nil
+}
+
+// add records a frame stored under name.
+func (h *storedHashes) add(hash, name string) {
+	if h.names != nil {
+		h.names[hash] = name
+	}
+}
+
+// Ingester stores uploaded files in a storage backend and, if it has a
+// catalog, records them there.
+type Ingester struct {
+	store  storage.Backend
+	cat    *catalog.Catalog
+	images Images
+}
+
+// NewIngester returns an Ingester storing images accepted by images in store.
+// cat may be nil.
+func NewIngester(store storage.Backend, cat *catalog.Catalog, images Images) *Ingester {
+	return &Ingester{store: store, cat: cat, images: images}
+}
+
+// sameExtension reports whether the file extensions a and b name the same
+// format.
+func sameExtension(a, b string) bool {
+	canonical := func(ext string) string {
+		ext = strings.ToLower(ext)
+		if ext == ".jpeg" {
+			return ".jpg"
+		}
+		return ext
+	}
+	return canonical(a) == canonical(b)
+}
+
+// ingest validates, hashes, names and stores one uploaded file and records it
+// in the catalog together with metadata, which may be nil. Stored content is
+// looked up in hashes, or in a new storedHashes if it is nil. Content that is
+// already stored is counted as a duplicate; with skipDuplicates it is reported
+// as such instead of being stored again. Problems with the file are reported
+// as a rejected result; the error is for failures of the server.
+func (in *Ingester) ingest(ctx context.Context, hashes *storedHashes, fileName string, content []byte, metadata map[string]string, skipDuplicates bool) (Result, error) {
+	// Hidden files are not frames, e.g. the "._" files macOS adds to archives.
+	if strings.HasPrefix(fileName, ".") {
+		return rejected(fileName, reasonInvalidName), nil
+	}
+	if !isImage(bytes.NewReader(content)) {
+		return rejected(fileName, reasonNotImage), nil
+	}
+	// Sniffing only looks at the first bytes; decoding checks the whole file.
+	checked, reason := in.images.check(content)
+	if reason != "" {
+		return rejected(fileName, reason), nil
+	}
+	content = checked.content
+
+	hash := sha256.Sum256(content)
+	hashString := hex.EncodeToString(hash[:])
+	ext := filepath.Ext(fileName)
+	baseName := strings.TrimSuffix(fileName, ext)
+	// The extension names the stored format, whatever the client called it.
+	if !sameExtension(ext, checked.ext) {
+		ext = checked.ext
+	}
+	newFileName := baseName + "_" + hashString + ext
+
+	if hashes == nil {
+		hashes = in.newStoredHashes()
+	}
+	existing, err := hashes.find(ctx, hashString)
+	if err != nil {
+		return Result{}, err
+	}
+	if existing != "" {
+		uploadDuplicates.Inc()
+		slog.InfoContext(ctx, "duplicate upload", "file", newFileName, "existing", existing)
+		if skipDuplicates {
+			return Result{File: fileName, Name: existing, Status: StatusDuplicate}, nil
+		}
+	}
+
+	written, err := in.store.Put(ctx, newFileName, bytes.NewReader(content))
+	if errors.Is(err, storage.ErrInvalidName) {
+		return rejected(fileName, reasonInvalidName), nil
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	uploadBytes.Add(float64(written))
+	slog.InfoContext(ctx, "stored upload", "file", newFileName, "bytes", written)
+	hashes.add(hashString, newFileName)
+
+	if in.cat != nil {
+		metadata := maps.Clone(metadata)
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		metadata["original_name"] = fileName
+		if key, ok := auth.FromContext(ctx); ok {
+			metadata["uploaded_by"] = key.Name
+		}
+		err := in.cat.Put(catalog.Frame{
+			Name:     newFileName,
+			Hash:     hashString,
+			Subtitle: baseName,
+			Size:     written,
+			Width:    checked.width,
+			Height:   checked.height,
+			Format:   checked.format,
+			Colors:   checked.colors,
+			AddedAt:  time.Now().UTC(),
+			Metadata: metadata,
+		})
+		// The frame index adds stored frames missing from the catalog, so
+		// the upload still succeeds.
+		if err != nil {
+			slog.ErrorContext(ctx, "add upload to catalog", "file", newFileName, "error", err)
+		}
+	}
+	return Result{File: fileName, Name: newFileName, Status: StatusCreated, Size: written}, nil
+}
@@ -1,11 +1,39 @@
 package upload
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
 	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"AnimeFrameBot/internal/catalog"
+	"AnimeFrameBot/internal/frame"
+	"AnimeFrameBot/internal/ratelimit"
+	"AnimeFrameBot/internal/storage"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -95,3 +123,796 @@ func TestIsImageFileReadError(t *testing.T) {
 	fileReader := &MockFileReader{}
 	assert.False(t, isImage(fileReader))
 }
+
+// countingStore counts the listings of its backend.
+type countingStore struct {
+	storage.Backend
+	lists int
+}
+
+func (s *countingStore) List(ctx context.Context, prefix string) ([]storage.ObjectInfo, error) {
+	s.lists++
+	return s.Backend.List(ctx, prefix)
+}
+
+func TestStoredHashes(t *testing.T) {
+	ctx := context.Background()
+	hash := strings.Repeat("a", 64)
+	names := []string{"x_" + hash + ".png", "y_" + strings.Repeat("b", 64) + ".png", hash + ".png"}
+
+	t.Run("store", func(t *testing.T) {
+		store := &countingStore{Backend: storage.NewMemory()}
+		for _, name := range names {
+			_, err := store.Put(ctx, name, strings.NewReader(name))
+			require.NoError(t, err)
+		}
+		hashes := NewIngester(store, nil, testImages).newStoredHashes()
+
+		name, err := hashes.find(ctx, hash)
+		require.NoError(t, err)
+		assert.Equal(t, "x_"+hash+".png", name)
+
+		name, err = hashes.find(ctx, strings.Repeat("c", 64))
+		require.NoError(t, err)
+		assert.Empty(t, name)
+
+		hashes.add(strings.Repeat("c", 64), "z.png")
+		name, err = hashes.find(ctx, strings.Repeat("c", 64))
+		require.NoError(t, err)
+		assert.Equal(t, "z.png", name)
+		assert.Equal(t, 1, store.lists)
+	})
+
+	t.Run("catalog", func(t *testing.T) {
+		cat, err := catalog.Open(filepath.Join(t.TempDir(), "catalog.db"))
+		require.NoError(t, err)
+		defer cat.Close()
+		require.NoError(t, cat.Put(catalog.Frame{Name: names[0], Hash: hash}))
+		store := &countingStore{Backend: storage.NewMemory()}
+		hashes := NewIngester(store, cat, testImages).newStoredHashes()
+
+		name, err := hashes.find(ctx, hash)
+		require.NoError(t, err)
+		assert.Equal(t, names[0], name)
+
+		name, err = hashes.find(ctx, strings.Repeat("c", 64))
+		require.NoError(t, err)
+		assert.Empty(t, name)
+		assert.Equal(t, 0, store.lists)
+	})
+}
+
+const pngHeader = "\x89PNG\r\n\x1a\n"
+
+// testImages are the image limits of the tests.
+var testImages = Images{MaxPixels: 100, MaxSide: 16}
+
+// testImage returns an image of the given format and size filled with shade.
+func testImage(format string, width, height int, shade uint8) string {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = shade
+	}
+	var b bytes.Buffer
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&b, img, nil)
+	case "gif":
+		err = gif.Encode(&b, img, nil)
+	default:
+		err = png.Encode(&b, img)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return b.String()
+}
+
+type batchFile struct {
+	name    string
+	content string
+}
+
+func multipartBatch(t *testing.T, files ...batchFile) (io.Reader, string) {
+	var b bytes.Buffer
+	bw := multipart.NewWriter(&b)
+	require.NoError(t, bw.WriteField("comment", "not a file"))
+	for _, f := range files {
+		fw, err := bw.CreateFormFile("images", f.name)
+		require.NoError(t, err)
+		_, err = fw.Write([]byte(f.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, bw.Close())
+	return &b, bw.FormDataContentType()
+}
+
+func zipBatch(t *testing.T, files ...batchFile) (io.Reader, string) {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	_, err := zw.Create("season1/")
+	require.NoError(t, err)
+	for _, f := range files {
+		fw, err := zw.Create(f.name)
+		require.NoError(t, err)
+		_, err = fw.Write([]byte(f.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return &b, "application/zip"
+}
+
+func tarBatch(t *testing.T, files ...batchFile) []byte {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "season1/", Typeflag: tar.TypeDir, Mode: 0o755}))
+	for _, f := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0o644, Size: int64(len(f.content))}))
+		_, err := tw.Write([]byte(f.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return b.Bytes()
+}
+
+func TestHandleBatch(t *testing.T) {
+	stored := testImage("png", 2, 2, 0)
+	hello := testImage("png", 2, 2, 255)
+	files := []batchFile{
+		{name: "season1/hello.png", content: hello},
+		{name: "season1/notes.txt", content: "not an image"},
+		{name: "season1/again.png", content: stored},
+		{name: "__MACOSX/season1/._hello.png", content: pngHeader + "resource fork"},
+		{name: "season1/huge.png", content: pngHeader + strings.Repeat("x", 300)},
+	}
+	wantResults := []Result{
+		{File: "hello.png", Status: StatusCreated},
+		{File: "notes.txt", Status: StatusRejected, Reason: reasonNotImage},
+		{File: "again.png", Status: StatusDuplicate},
+		{File: "._hello.png", Status: StatusRejected, Reason: reasonInvalidName},
+		{File: "huge.png", Status: StatusRejected, Reason: reasonTooLarge},
+	}
+
+	tests := []struct {
+		name       string
+		body       func(t *testing.T) (io.Reader, string)
+		wantStatus int
+		wantError  string
+		// wantFiles is the number of files reported, from the start of wantResults.
+		wantFiles int
+	}{
+		{
+			name: "multipart",
+			body: func(t *testing.T) (io.Reader, string) {
+				parts := make([]batchFile, len(files))
+				for i, f := range files {
+					parts[i] = batchFile{name: f.name[strings.LastIndex(f.name, "/")+1:], content: f.content}
+				}
+				return multipartBatch(t, parts...)
+			},
+			wantStatus: http.StatusOK,
+			wantFiles:  5,
+		},
+		{
+			name:       "zip",
+			body:       func(t *testing.T) (io.Reader, string) { return zipBatch(t, files...) },
+			wantStatus: http.StatusOK,
+			wantFiles:  5,
+		},
+		{
+			name: "tar",
+			body: func(t *testing.T) (io.Reader, string) {
+				return bytes.NewReader(tarBatch(t, files...)), "application/x-tar"
+			},
+			wantStatus: http.StatusOK,
+			wantFiles:  5,
+		},
+		{
+			name: "gzipped tar",
+			body: func(t *testing.T) (io.Reader, string) {
+				var b bytes.Buffer
+				gz := gzip.NewWriter(&b)
+				_, err := gz.Write(tarBatch(t, files...))
+				require.NoError(t, err)
+				require.NoError(t, gz.Close())
+				return &b, "application/gzip"
+			},
+			wantStatus: http.StatusOK,
+			wantFiles:  5,
+		},
+		{
+			name: "truncated tar",
+			body: func(t *testing.T) (io.Reader, string) {
+				// The archive ends in the middle of notes.txt.
+				archive := tarBatch(t, files...)
+				return bytes.NewReader(archive[:512+1024+512+5]), "application/x-tar"
+			},
+			wantStatus: http.StatusBadRequest,
+			wantError:  "invalid batch: unexpected EOF",
+			wantFiles:  1,
+		},
+		{
+			name:       "broken zip",
+			body:       func(t *testing.T) (io.Reader, string) { return strings.NewReader("PK"), "application/zip" },
+			wantStatus: http.StatusBadRequest,
+			wantError:  "invalid batch: zip: not a valid zip file",
+		},
+		{
+			name: "request too large",
+			body: func(t *testing.T) (io.Reader, string) {
+				// The body ends up too large while skipping the rest of huge.png.
+				huge := batchFile{name: "huge.png", content: pngHeader + strings.Repeat("x", 10000)}
+				return bytes.NewReader(tarBatch(t, append(files[:4:4], huge)...)), "application/x-tar"
+			},
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantError:  "Request too large",
+			wantFiles:  5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := storage.NewMemory()
+			_, err := store.Put(context.Background(), "stored_"+sha256Hex(stored)+".png", strings.NewReader(stored))
+			require.NoError(t, err)
+
+			body, contentType := tt.body(t)
+			req := httptest.NewRequest(http.MethodPost, "/frame/batch", body)
+			req.Header.Set("Content-Type", contentType)
+			w := httptest.NewRecorder()
+			HandleBatch(NewIngester(store, nil, testImages), 256, 8192).ServeHTTP(w, req)
+			require.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+
+			var response BatchResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, tt.wantError, response.Error)
+			require.Len(t, response.Results, tt.wantFiles)
+			for i, result := range response.Results {
+				assert.Equal(t, wantResults[i].File, result.File)
+				assert.Equal(t, wantResults[i].Status, result.Status)
+				assert.Equal(t, wantResults[i].Reason, result.Reason)
+			}
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, BatchResponse{Created: 1, Duplicates: 1, Rejected: 3, Results: response.Results}, response)
+				assert.Equal(t, "hello_"+sha256Hex(hello)+".png", response.Results[0].Name)
+				assert.Equal(t, "stored_"+sha256Hex(stored)+".png", response.Results[2].Name)
+				_, err := store.Stat(context.Background(), response.Results[0].Name)
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/frame/batch", strings.NewReader("{}"))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	HandleBatch(NewIngester(storage.NewMemory(), nil, testImages), 256, 8192).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+}
+
+func TestHandleBatchQuota(t *testing.T) {
+	store := storage.NewMemory()
+	quotas := ratelimit.NewQuotas(ratelimit.Quota{MaxCount: 2})
+	handler := ratelimit.LimitUploads(quotas, HandleBatch(NewIngester(store, nil, testImages), 256, 8192))
+	upload := func(files ...batchFile) BatchResponse {
+		t.Helper()
+		body, contentType := multipartBatch(t, files...)
+		req := httptest.NewRequest(http.MethodPost, "/frame/batch", body)
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response BatchResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	// Files that would go over the quota are rejected, the ones before are
+	// stored.
+	response := upload(
+		batchFile{name: "a.png", content: testImage("png", 1, 1, 1)},
+		batchFile{name: "b.png", content: testImage("png", 1, 1, 2)},
+		batchFile{name: "c.png", content: testImage("png", 1, 1, 3)},
+	)
+	assert.Equal(t, 2, response.Created)
+	assert.Equal(t, 1, response.Rejected)
+	assert.Equal(t, reasonQuota, response.Results[2].Reason)
+	objects, err := store.List(context.Background(), "")
+	require.NoError(t, err)
+	assert.Len(t, objects, 2)
+}
+
+// jpegSegment returns a JPEG segment with the given marker.
+func jpegSegment(marker byte, payload string) string {
+	return string([]byte{0xFF, marker, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}) + payload
+}
+
+// pngChunk returns a PNG chunk of the given type.
+func pngChunk(chunkType, data string) string {
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.BigEndian, uint32(len(data)))
+	b.WriteString(chunkType + data)
+	_ = binary.Write(&b, binary.BigEndian, crc32.ChecksumIEEE([]byte(chunkType+data)))
+	return b.String()
+}
+
+// tiffOrientation returns big endian EXIF data with just an orientation.
+func tiffOrientation(orientation uint16) string {
+	return "MM\x00\x2a\x00\x00\x00\x08" + "\x00\x01" +
+		"\x01\x12\x00\x03\x00\x00\x00\x01" + string([]byte{byte(orientation >> 8), byte(orientation), 0, 0}) +
+		"\x00\x00\x00\x00"
+}
+
+func TestImagesCheck(t *testing.T) {
+	jpegImage := testImage("jpeg", 4, 2, 200)
+	pngImage := testImage("png", 4, 2, 200)
+	// withJPEG and withPNG insert metadata after the first segment or chunk.
+	withJPEG := func(segments ...string) string {
+		return jpegImage[:2] + strings.Join(segments, "") + jpegImage[2:]
+	}
+	ihdrEnd := len(pngHeader) + 25
+	withPNG := func(chunks ...string) string {
+		return pngImage[:ihdrEnd] + strings.Join(chunks, "") + pngImage[ihdrEnd:]
+	}
+	reencode := Images{MaxPixels: 100, MaxSide: 16, Reencode: true}
+
+	tests := []struct {
+		name       string
+		images     Images
+		content    string
+		wantReason string
+		// want is the content to store, if it is not re-encoded.
+		want    string
+		wantExt string
+		// wantWidth is the width of re-encoded images.
+		wantWidth int
+	}{
+		{name: "jpeg", images: testImages, content: jpegImage, want: jpegImage, wantExt: ".jpg"},
+		{name: "png", images: testImages, content: pngImage, want: pngImage, wantExt: ".png"},
+		{name: "gif", images: testImages, content: testImage("gif", 4, 2, 200), wantExt: ".png", wantWidth: 4},
+		{name: "only a signature", images: testImages, content: "\xFF\xD8\xFF", wantReason: reasonNotImage},
+		{name: "truncated", images: testImages, content: pngImage[:len(pngImage)-20], wantReason: reasonNotImage},
+		{name: "unsupported format", images: testImages, content: "BM" + strings.Repeat("\x00", 60), wantReason: reasonNotImage},
+		{name: "too wide", images: testImages, content: testImage("png", 17, 1, 0), wantReason: reasonImageTooLarge + ": 17x1"},
+		{name: "too many pixels", images: testImages, content: testImage("png", 11, 10, 0), wantReason: reasonImageTooLarge + ": 11x10"},
+		{
+			name:   "jpeg metadata",
+			images: testImages,
+			content: withJPEG(
+				jpegSegment(0xE1, "Exif\x00\x00"+tiffOrientation(1)),
+				jpegSegment(0xE1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>"),
+				jpegSegment(0xE2, "ICC_PROFILE\x00\x01\x01profile"),
+				jpegSegment(0xFE, "comment"),
+			),
+			want:    jpegImage,
+			wantExt: ".jpg",
+		},
+		{
+			name:   "png metadata",
+			images: testImages,
+			content: withPNG(
+				pngChunk("eXIf", tiffOrientation(1)),
+				pngChunk("iTXt", "XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>"),
+				pngChunk("tEXt", "Comment\x00hi"),
+			) + "trailing",
+			want:    pngImage,
+			wantExt: ".png",
+		},
+		{
+			name:      "jpeg orientation",
+			images:    testImages,
+			content:   withJPEG(jpegSegment(0xE1, "Exif\x00\x00"+tiffOrientation(6))),
+			wantExt:   ".jpg",
+			wantWidth: 2,
+		},
+		{
+			name:      "png orientation",
+			images:    testImages,
+			content:   withPNG(pngChunk("eXIf", tiffOrientation(8))),
+			wantExt:   ".png",
+			wantWidth: 2,
+		},
+		{
+			name:      "orientation while re-encoding",
+			images:    reencode,
+			content:   withPNG(pngChunk("eXIf", tiffOrientation(3))),
+			wantExt:   ".png",
+			wantWidth: 4,
+		},
+		{name: "reencoded jpeg", images: reencode, content: jpegImage, wantExt: ".jpg", wantWidth: 4},
+		{name: "reencoded gif", images: reencode, content: testImage("gif", 4, 2, 200), wantExt: ".png", wantWidth: 4},
+		{name: "reencoding drops trailing data", images: reencode, content: pngImage + "<?php ?>", wantExt: ".png", wantWidth: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checked, reason := tt.images.check([]byte(tt.content))
+			assert.Equal(t, tt.wantReason, reason)
+			assert.Equal(t, tt.wantExt, checked.ext)
+			if tt.wantReason != "" {
+				assert.Nil(t, checked.content)
+				return
+			}
+			config, format, err := image.DecodeConfig(bytes.NewReader(checked.content))
+			require.NoError(t, err)
+			assert.Equal(t, format, checked.format)
+			assert.Equal(t, config.Width, checked.width)
+			assert.Equal(t, config.Height, checked.height)
+			assert.NotEmpty(t, checked.colors)
+			if tt.want != "" {
+				assert.Equal(t, tt.want, string(checked.content))
+				return
+			}
+			assert.Equal(t, tt.wantWidth, config.Width)
+			assert.Equal(t, 8/tt.wantWidth, config.Height)
+			assert.NotContains(t, string(checked.content), "Exif")
+			assert.NotContains(t, string(checked.content), "<?php")
+		})
+	}
+}
+
+func TestIngestExtension(t *testing.T) {
+	tests := []struct {
+		file    string
+		content string
+		wantExt string
+	}{
+		{file: "a.jpeg", content: testImage("jpeg", 2, 2, 1), wantExt: ".jpeg"},
+		{file: "b.PNG", content: testImage("png", 2, 2, 2), wantExt: ".PNG"},
+		{file: "c.jpg", content: testImage("png", 2, 2, 3), wantExt: ".png"},
+		{file: "d.gif", content: testImage("gif", 2, 2, 4), wantExt: ".png"},
+		{file: "e", content: testImage("jpeg", 2, 2, 5), wantExt: ".jpg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			in := NewIngester(storage.NewMemory(), nil, testImages)
+			result, err := in.ingest(context.Background(), nil, tt.file, []byte(tt.content), nil, false)
+			require.NoError(t, err)
+			require.Equal(t, StatusCreated, result.Status, result.Reason)
+			assert.Equal(t, tt.wantExt, filepath.Ext(result.Name))
+			// Stored frames keep their names when the library is scanned.
+			assert.True(t, frame.IsValidFileName(result.Name), result.Name)
+		})
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// The pixels of a 3x2 image, row by row:
+	//   1 2 3
+	//   4 5 6
+	src := image.NewGray(image.Rect(10, 10, 13, 12))
+	copy(src.Pix, []uint8{1, 2, 3, 4, 5, 6})
+
+	tests := []struct {
+		orientation int
+		want        [][]uint8
+	}{
+		{orientation: 1, want: [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+		{orientation: 2, want: [][]uint8{{3, 2, 1}, {6, 5, 4}}},
+		{orientation: 3, want: [][]uint8{{6, 5, 4}, {3, 2, 1}}},
+		{orientation: 4, want: [][]uint8{{4, 5, 6}, {1, 2, 3}}},
+		{orientation: 5, want: [][]uint8{{1, 4}, {2, 5}, {3, 6}}},
+		{orientation: 6, want: [][]uint8{{4, 1}, {5, 2}, {6, 3}}},
+		{orientation: 7, want: [][]uint8{{6, 3}, {5, 2}, {4, 1}}},
+		{orientation: 8, want: [][]uint8{{3, 6}, {2, 5}, {1, 4}}},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.orientation), func(t *testing.T) {
+			img := orient(src, tt.orientation)
+			b := img.Bounds()
+			got := make([][]uint8, b.Dy())
+			for y := range got {
+				for x := 0; x < b.Dx(); x++ {
+					got[y] = append(got[y], color.GrayModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.Gray).Y)
+				}
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr   string
+		public bool
+	}{
+		{addr: "93.184.216.34", public: true},
+		{addr: "2606:2800:220:1:248:1893:25c8:1946", public: true},
+		{addr: "127.0.0.1", public: false},
+		{addr: "::1", public: false},
+		{addr: "10.1.2.3", public: false},
+		{addr: "172.16.0.1", public: false},
+		{addr: "192.168.1.1", public: false},
+		{addr: "169.254.169.254", public: false},
+		{addr: "100.64.0.1", public: false},
+		{addr: "0.0.0.0", public: false},
+		{addr: "224.0.0.1", public: false},
+		{addr: "fd00::1", public: false},
+		{addr: "fe80::1", public: false},
+		{addr: "::ffff:127.0.0.1", public: false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.public, publicAddr(netip.MustParseAddr(tt.addr)), tt.addr)
+	}
+}
+
+func TestHandleImport(t *testing.T) {
+	png := testImage("png", 2, 2, 128)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/img/hello.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = io.WriteString(w, png)
+	})
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = io.WriteString(w, "<html></html>")
+	})
+	mux.HandleFunc("/fake.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = io.WriteString(w, "not an image")
+	})
+	mux.HandleFunc("/huge.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = io.WriteString(w, pngHeader+strings.Repeat("x", 300))
+	})
+	mux.HandleFunc("/chunked.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		for i := 0; i < 10; i++ {
+			_, _ = io.WriteString(w, pngHeader+strings.Repeat("x", 30))
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/slow.png", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/img/hello.png", http.StatusFound)
+	})
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+	})
+	source := httptest.NewServer(mux)
+	defer source.Close()
+
+	helloName := "hello_" + sha256Hex(png) + ".png"
+	tests := []struct {
+		name         string
+		body         string
+		blockPrivate bool
+		wantStatus   int
+		wantBody     string
+	}{
+		{name: "subtitle from url", body: `{"url":"` + source.URL + `/img/hello.png"}`, wantStatus: http.StatusCreated, wantBody: `{"file":"hello.png","name":"` + helloName + `","status":"created"}`},
+		{name: "subtitle given", body: `{"url":"` + source.URL + `/redirect","subtitle":"hi there"}`, wantStatus: http.StatusCreated, wantBody: `"name":"hi there_` + sha256Hex(png) + `.png"`},
+		{name: "private address", body: `{"url":"` + source.URL + `/img/hello.png"}`, blockPrivate: true, wantStatus: http.StatusBadRequest, wantBody: "address is not public"},
+		{name: "not http", body: `{"url":"file:///etc/passwd","subtitle":"x"}`, wantStatus: http.StatusBadRequest, wantBody: errInvalidURL.Error()},
+		{name: "redirect away from http", body: `{"url":"` + source.URL + `/file","subtitle":"x"}`, wantStatus: http.StatusBadRequest, wantBody: errInvalidURL.Error()},
+		{name: "no url", body: `{"subtitle":"x"}`, wantStatus: http.StatusBadRequest, wantBody: "url is required"},
+		{name: "no subtitle", body: `{"url":"` + source.URL + `/"}`, wantStatus: http.StatusBadRequest, wantBody: "subtitle is required"},
+		{name: "invalid json", body: `{`, wantStatus: http.StatusBadRequest, wantBody: "Invalid JSON"},
+		{name: "not found", body: `{"url":"` + source.URL + `/missing.png"}`, wantStatus: http.StatusBadGateway, wantBody: "source responded 404 Not Found"},
+		{name: "not an image type", body: `{"url":"` + source.URL + `/page","subtitle":"x"}`, wantStatus: http.StatusBadGateway, wantBody: `content type "text/html" is not an image`},
+		{name: "not an image", body: `{"url":"` + source.URL + `/fake.png"}`, wantStatus: http.StatusBadRequest, wantBody: reasonNotImage},
+		{name: "too large", body: `{"url":"` + source.URL + `/huge.png"}`, wantStatus: http.StatusBadGateway, wantBody: reasonTooLarge},
+		{name: "too large without length", body: `{"url":"` + source.URL + `/chunked.png"}`, wantStatus: http.StatusBadGateway, wantBody: reasonTooLarge},
+		{name: "too slow", body: `{"url":"` + source.URL + `/slow.png"}`, wantStatus: http.StatusBadGateway, wantBody: "Timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := storage.NewMemory()
+			fetcher := NewFetcher(200*time.Millisecond, 256, !tt.blockPrivate)
+			w := httptest.NewRecorder()
+			HandleImport(NewIngester(store, nil, testImages), fetcher).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/frame/import", strings.NewReader(tt.body)))
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Contains(t, w.Body.String(), tt.wantBody)
+
+			objects, err := store.List(context.Background(), "")
+			require.NoError(t, err)
+			if tt.wantStatus == http.StatusCreated {
+				assert.Len(t, objects, 1)
+			} else {
+				assert.Empty(t, objects)
+			}
+		})
+	}
+
+	// Content that is already stored is not stored again.
+	store := storage.NewMemory()
+	handler := HandleImport(NewIngester(store, nil, testImages), NewFetcher(time.Second, 256, true))
+	for _, want := range []int{http.StatusCreated, http.StatusOK} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/frame/import", strings.NewReader(`{"url":"`+source.URL+`/img/hello.png"}`)))
+		assert.Equal(t, want, w.Code)
+		assert.Contains(t, w.Body.String(), `"name":"`+helloName+`"`)
+	}
+	objects, err := store.List(context.Background(), "")
+	require.NoError(t, err)
+	assert.Len(t, objects, 1)
+}
+
+func TestResumable(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemory()
+	dir := filepath.Join(t.TempDir(), "uploads")
+	res := NewResumable(dir, time.Hour)
+	mux := http.NewServeMux()
+	mux.Handle("POST /frame/uploads", HandleResumableCreate(res, 256, 8192))
+	mux.Handle("HEAD /frame/uploads/{id}", HandleResumableStatus(res))
+	mux.Handle("PATCH /frame/uploads/{id}", HandleResumableChunk(res))
+	mux.Handle("DELETE /frame/uploads/{id}", HandleResumableCancel(res))
+	mux.Handle("POST /frame/uploads/{id}/finalize", HandleResumableFinalize(res, NewIngester(store, nil, testImages), 256))
+
+	do := func(method, target string, header map[string]string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	create := func(fileName string, length int) *httptest.ResponseRecorder {
+		return do(http.MethodPost, "/frame/uploads", map[string]string{
+			"Upload-Length":   strconv.Itoa(length),
+			"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(fileName)) + ",note",
+		}, "")
+	}
+	patch := func(location string, offset int, chunk string) *httptest.ResponseRecorder {
+		return do(http.MethodPatch, location, map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": strconv.Itoa(offset),
+		}, chunk)
+	}
+
+	// Invalid uploads are refused before anything is staged.
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/frame/uploads", nil, "").Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/frame/uploads", map[string]string{"Upload-Length": "10"}, "").Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, create("big.png", 257).Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodHead, "/frame/uploads/not-an-id", nil, "").Code)
+
+	image := testImage("png", 3, 3, 64)
+	w := create("resumed.png", len(image))
+	require.Equal(t, http.StatusCreated, w.Code)
+	location := w.Header().Get("Location")
+	assert.Equal(t, "0", w.Header().Get("Upload-Offset"))
+	assert.NotEmpty(t, w.Header().Get("Upload-Expires"))
+
+	w = patch(location, 0, image[:10])
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "10", w.Header().Get("Upload-Offset"))
+	w = patch(location, 5, image[5:])
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, "10", w.Header().Get("Upload-Offset"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, do(http.MethodPatch, location, map[string]string{"Upload-Offset": "10"}, image[10:]).Code)
+	assert.Equal(t, http.StatusConflict, do(http.MethodPost, location+"/finalize", nil, "").Code)
+
+	w = do(http.MethodHead, location, nil, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "10", w.Header().Get("Upload-Offset"))
+	assert.Equal(t, strconv.Itoa(len(image)), w.Header().Get("Upload-Length"))
+
+	w = patch(location, 10, image[10:]+"extra")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, strconv.Itoa(len(image)), w.Header().Get("Upload-Offset"))
+
+	w = do(http.MethodPost, location+"/finalize", nil, "")
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Contains(t, w.Body.String(), `"name":"resumed_`+sha256Hex(image)+`.png","status":"created"`)
+	_, err := store.Stat(ctx, "resumed_"+sha256Hex(image)+".png")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodHead, location, nil, "").Code)
+
+	// Content that is already stored is not stored again.
+	w = create("again.png", len(image))
+	require.Equal(t, http.StatusCreated, w.Code)
+	location = w.Header().Get("Location")
+	require.Equal(t, http.StatusNoContent, patch(location, 0, image).Code)
+	w = do(http.MethodPost, location+"/finalize", nil, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"name":"resumed_`+sha256Hex(image)+`.png","status":"duplicate"`)
+
+	// Archives are finalized as a batch.
+	archive := tarBatch(t, batchFile{name: "a.png", content: testImage("png", 1, 1, 32)}, batchFile{name: "b.txt", content: "b"})
+	w = create("season.tar", len(archive))
+	require.Equal(t, http.StatusCreated, w.Code)
+	location = w.Header().Get("Location")
+	require.Equal(t, http.StatusNoContent, patch(location, 0, string(archive)).Code)
+	w = do(http.MethodPost, location+"/finalize", nil, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"created":1,"duplicates":0,"rejected":1`)
+
+	// Uploads belong to the key that created them.
+	u, err := res.create("mine.png", 10, "alice", nil)
+	require.NoError(t, err)
+	_, err = res.get(u.ID, "bob")
+	assert.ErrorIs(t, err, errUploadNotFound)
+	_, err = res.get(u.ID, "alice")
+	assert.NoError(t, err)
+
+	// Cancelled and expired uploads are removed.
+	w = create("cancelled.png", 10)
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, w.Header().Get("Location"), nil, "").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodHead, w.Header().Get("Location"), nil, "").Code)
+
+	res.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	w = create("late.png", 10)
+	require.Equal(t, http.StatusCreated, w.Code)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2, "only the new upload is left")
+}
+
+func TestResumableQuota(t *testing.T) {
+	res := NewResumable(t.TempDir(), time.Hour)
+	quotas := ratelimit.NewQuotas(ratelimit.Quota{MaxBytes: 100})
+	handler := ratelimit.LimitUploads(quotas, HandleResumableCreate(res, 256, 8192))
+	create := func(length int) int {
+		req := httptest.NewRequest(http.MethodPost, "/frame/uploads", nil)
+		req.Header.Set("Upload-Length", strconv.Itoa(length))
+		req.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("staged.png")))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Staged uploads may not add up to more than the quota left.
+	assert.Equal(t, http.StatusCreated, create(60))
+	assert.Equal(t, http.StatusTooManyRequests, create(60))
+	assert.Equal(t, http.StatusCreated, create(40))
+}
+
+func TestResumableRun(t *testing.T) {
+	res := NewResumable(t.TempDir(), time.Hour)
+	_, err := res.create("old.png", 10, "", nil)
+	require.NoError(t, err)
+	res.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go res.Run(ctx, time.Millisecond)
+	assert.Eventually(t, func() bool {
+		entries, err := os.ReadDir(res.dir)
+		return err == nil && len(entries) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestDominantColors(t *testing.T) {
+	// Three quarters red in two shades, a quarter blue and a transparent row.
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 5))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			c := color.NRGBA{R: 250, A: 255}
+			if x == 3 {
+				c = color.NRGBA{B: 255, A: 255}
+			} else if y%2 == 1 {
+				c = color.NRGBA{R: 240, A: 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	img.SetNRGBA(0, 4, color.NRGBA{G: 255, A: 10})
+	assert.Equal(t, []string{"#f50000", "#0000ff"}, dominantColors(img))
+
+	assert.Equal(t, []string{}, dominantColors(image.NewNRGBA(image.Rect(0, 0, 2, 2))))
+}
+
+func FuzzImagesCheck(f *testing.F) {
+	f.Add([]byte(testImage("jpeg", 2, 2, 0)[:2] + jpegSegment(0xE1, "Exif\x00\x00"+tiffOrientation(6)) + testImage("jpeg", 2, 2, 0)[2:]))
+	f.Add([]byte(testImage("png", 2, 2, 0)))
+	f.Add([]byte(testImage("gif", 2, 2, 0)))
+	f.Fuzz(func(t *testing.T, content []byte) {
+		checked, reason := testImages.check(content)
+		if reason != "" {
+			return
+		}
+		_, _, err := image.Decode(bytes.NewReader(checked.content))
+		assert.NoError(t, err)
+	})
+}